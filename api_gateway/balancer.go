@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Strategies accepted in UpstreamConfig.Balance.
+const (
+	balanceRoundRobin     = "round_robin"
+	balanceLeastConn      = "least_conn"
+	balanceConsistentHash = "consistent_hash"
+)
+
+// HealthCheckConfig enables active health checks of every target of an
+// upstream. An empty Path disables them and all targets stay in rotation.
+type HealthCheckConfig struct {
+	Path               string        `yaml:"path"`                // e.g. /healthz
+	Interval           time.Duration `yaml:"interval"`            // default 5s
+	Timeout            time.Duration `yaml:"timeout"`             // default 2s
+	HealthyThreshold   int           `yaml:"healthy_threshold"`   // passes to re-add a target (default 2)
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"` // failures to remove a target (default 3)
+}
+
+func (hc HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if hc.Interval == 0 {
+		hc.Interval = 5 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	return hc
+}
+
+func (hc HealthCheckConfig) validate() error {
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return errors.New("health_check path must start with /")
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return errors.New("health_check settings must not be negative")
+	}
+	return nil
+}
+
+func validateBalance(s string) error {
+	switch s {
+	case "", balanceRoundRobin, balanceLeastConn, balanceConsistentHash:
+		return nil
+	}
+	return fmt.Errorf("unknown balance strategy %q", s)
+}
+
+// target is one instance of an upstream.
+type target struct {
+	url     *url.URL
+	healthy atomic.Bool
+	active  atomic.Int64 // requests whose response body is still open
+
+	passes, fails int // consecutive health check results, guarded by targetPool.mu
+}
+
+// targetPool balances requests over the targets of an upstream and runs its
+// health checks. Targets keep their health and connection counts across
+// reloads as long as their URL stays in the config.
+type targetPool struct {
+	name   string
+	client *http.Client
+	next   atomic.Uint64
+
+	mu      sync.Mutex
+	targets []*target // replaced, never modified, on update
+	balance string
+	hc      HealthCheckConfig
+	stop    context.CancelFunc
+}
+
+func newTargetPool(name string, transport http.RoundTripper) *targetPool {
+	return &targetPool{name: name, client: &http.Client{
+		Transport:     transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+}
+
+func (p *targetPool) update(urls []*url.URL, balance string, hc HealthCheckConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := map[string]*target{}
+	for _, t := range p.targets {
+		existing[t.url.String()] = t
+	}
+	targets := make([]*target, 0, len(urls))
+	for _, u := range urls {
+		t, ok := existing[u.String()]
+		if !ok {
+			t = &target{url: u}
+			t.healthy.Store(true)
+		}
+		if hc.Path == "" {
+			t.healthy.Store(true)
+			t.passes, t.fails = 0, 0
+		}
+		targets = append(targets, t)
+	}
+	p.targets, p.balance, p.hc = targets, balance, hc.withDefaults()
+	if hc.Path != "" && p.stop == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stop = cancel
+		go p.runHealthChecks(ctx)
+	}
+}
+
+func (p *targetPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		p.stop()
+		p.stop = nil
+	}
+}
+
+// pick chooses the target for one attempt. key is only used by
+// consistent_hash. When every target is unhealthy the pool fails open and
+// balances over all of them rather than rejecting traffic outright.
+func (p *targetPool) pick(key string) *target {
+	p.mu.Lock()
+	all, balance := p.targets, p.balance
+	p.mu.Unlock()
+	candidates := make([]*target, 0, len(all))
+	for _, t := range all {
+		if t.healthy.Load() {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = all
+	}
+	n := p.next.Add(1) - 1
+	switch {
+	case balance == balanceLeastConn:
+		// start at a rotating offset so ties are spread round robin
+		var best *target
+		for i := range candidates {
+			t := candidates[(int(n%uint64(len(candidates)))+i)%len(candidates)]
+			if best == nil || t.active.Load() < best.active.Load() {
+				best = t
+			}
+		}
+		return best
+	case balance == balanceConsistentHash && key != "":
+		// rendezvous hashing: only keys of a removed target move elsewhere
+		var best *target
+		var bestScore uint64
+		for _, t := range candidates {
+			h := fnv.New64a()
+			io.WriteString(h, key)
+			io.WriteString(h, "|")
+			io.WriteString(h, t.url.String())
+			if s := h.Sum64(); best == nil || s > bestScore {
+				best, bestScore = t, s
+			}
+		}
+		return best
+	}
+	return candidates[n%uint64(len(candidates))]
+}
+
+func (p *targetPool) runHealthChecks(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		targets, hc := p.targets, p.hc
+		p.mu.Unlock()
+		if hc.Path != "" {
+			var wg sync.WaitGroup
+			for _, t := range targets {
+				wg.Add(1)
+				go func(t *target) {
+					defer wg.Done()
+					p.report(t, p.probe(ctx, t, hc))
+				}(t)
+			}
+			wg.Wait()
+		}
+		timer := time.NewTimer(hc.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (p *targetPool) probe(ctx context.Context, t *target, hc HealthCheckConfig) bool {
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, joinURLPath(t.url, hc.Path), nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", "api_gateway-healthcheck")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func (p *targetPool) report(t *target, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hc.Path == "" {
+		return
+	}
+	if ok {
+		t.passes, t.fails = t.passes+1, 0
+	} else {
+		t.passes, t.fails = 0, t.fails+1
+	}
+	switch {
+	case !t.healthy.Load() && t.passes >= p.hc.HealthyThreshold:
+		t.healthy.Store(true)
+		log.Info().Str("upstream", p.name).Str("target", t.url.String()).Msg("upstream_target_healthy")
+	case t.healthy.Load() && t.fails >= p.hc.UnhealthyThreshold:
+		t.healthy.Store(false)
+		log.Warn().Str("upstream", p.name).Str("target", t.url.String()).Msg("upstream_target_unhealthy")
+	}
+}
+
+func (p *targetPool) snapshot() []gin.H {
+	p.mu.Lock()
+	targets := p.targets
+	p.mu.Unlock()
+	out := make([]gin.H, 0, len(targets))
+	for _, t := range targets {
+		out = append(out, gin.H{"url": t.url.String(), "healthy": t.healthy.Load(), "active": t.active.Load()})
+	}
+	return out
+}
+
+func joinURLPath(base *url.URL, path string) string {
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + path
+	u.RawPath = ""
+	return u.String()
+}
+
+type balanceKeyCtx struct{}
+
+// withBalanceKey tags ctx with the caller identity used by consistent_hash.
+func withBalanceKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, balanceKeyCtx{}, key)
+}
+
+// balancerTransport sends each attempt to a target picked from the pool, so a
+// retried request can land on a different instance.
+type balancerTransport struct {
+	next http.RoundTripper
+	pool *targetPool
+}
+
+func (t *balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, _ := req.Context().Value(balanceKeyCtx{}).(string)
+	tg := t.pool.pick(key)
+	out := req.Clone(req.Context())
+	out.URL.Scheme, out.URL.Host = tg.url.Scheme, tg.url.Host
+	out.URL.Path = strings.TrimSuffix(tg.url.Path, "/") + req.URL.Path
+	out.URL.RawPath = ""
+	out.Host = ""
+	tg.active.Add(1)
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		tg.active.Add(-1)
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the proxy needs the raw io.ReadWriteCloser for upgrades, so long
+		// lived upgraded connections are not counted
+		tg.active.Add(-1)
+		return resp, nil
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, done: func() { tg.active.Add(-1) }}
+	return resp, nil
+}
+
+// trackedBody calls done once when the response body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
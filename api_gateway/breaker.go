@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// BreakerConfig tunes the circuit breaker of one upstream. Zero values fall
+// back to the defaults in withDefaults.
+type BreakerConfig struct {
+	FailureRatio        float64       `yaml:"failure_ratio"`        // open when failures/requests reaches this
+	MinRequests         int           `yaml:"min_requests"`         // requests in the window before the ratio applies
+	ConsecutiveFailures int           `yaml:"consecutive_failures"` // open after this many failures in a row
+	Window              time.Duration `yaml:"window"`               // closed state counters reset every window
+	Cooldown            time.Duration `yaml:"cooldown"`             // time spent open before probing
+	HalfOpenRequests    int           `yaml:"half_open_requests"`   // probes that must succeed to close again
+}
+
+func (bc BreakerConfig) withDefaults() BreakerConfig {
+	if bc.FailureRatio == 0 {
+		bc.FailureRatio = 0.5
+	}
+	if bc.MinRequests == 0 {
+		bc.MinRequests = 10
+	}
+	if bc.ConsecutiveFailures == 0 {
+		bc.ConsecutiveFailures = 5
+	}
+	if bc.Window == 0 {
+		bc.Window = 30 * time.Second
+	}
+	if bc.Cooldown == 0 {
+		bc.Cooldown = 15 * time.Second
+	}
+	if bc.HalfOpenRequests == 0 {
+		bc.HalfOpenRequests = 1
+	}
+	return bc
+}
+
+func (bc BreakerConfig) validate() error {
+	if bc.FailureRatio < 0 || bc.FailureRatio > 1 {
+		return errors.New("breaker failure_ratio must be between 0 and 1")
+	}
+	if bc.MinRequests < 0 || bc.ConsecutiveFailures < 0 || bc.HalfOpenRequests < 0 {
+		return errors.New("breaker counts must not be negative")
+	}
+	if bc.Window < 0 || bc.Cooldown < 0 {
+		return errors.New("breaker durations must not be negative")
+	}
+	return nil
+}
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// errCircuitOpen is returned by the transport while a breaker rejects calls.
+type errCircuitOpen struct {
+	upstream   string
+	retryAfter time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit open for upstream %s", e.upstream)
+}
+
+// circuitBreaker is a closed/open/half-open breaker. Results are tagged with
+// the generation they started in so that slow calls finishing after a state
+// change do not affect the new state.
+type circuitBreaker struct {
+	name string
+	now  func() time.Time
+
+	mu          sync.Mutex
+	cfg         BreakerConfig
+	state       breakerState
+	generation  uint64
+	windowStart time.Time
+	openedAt    time.Time
+	requests    int
+	failures    int
+	consecutive int
+	inFlight    int // half-open probes in progress
+	successes   int // half-open probes that succeeded
+}
+
+func newCircuitBreaker(name string, cfg BreakerConfig) *circuitBreaker {
+	b := &circuitBreaker{name: name, cfg: cfg.withDefaults(), now: time.Now}
+	b.windowStart = b.now()
+	return b
+}
+
+// allow reports whether a call may proceed and returns the generation to pass
+// to record.
+func (b *circuitBreaker) allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	switch b.state {
+	case stateClosed:
+		if now.Sub(b.windowStart) >= b.cfg.Window {
+			b.resetCounts(now)
+		}
+	case stateOpen:
+		if wait := b.cfg.Cooldown - now.Sub(b.openedAt); wait > 0 {
+			return 0, &errCircuitOpen{upstream: b.name, retryAfter: wait}
+		}
+		b.setState(stateHalfOpen, now)
+	}
+	if b.state == stateHalfOpen {
+		if b.inFlight+b.successes >= b.cfg.HalfOpenRequests {
+			return 0, &errCircuitOpen{upstream: b.name, retryAfter: time.Second}
+		}
+		b.inFlight++
+	}
+	b.requests++
+	return b.generation, nil
+}
+
+// record reports the outcome of a call admitted by allow. A nil success means
+// the call was abandoned by the client and says nothing about the upstream.
+func (b *circuitBreaker) record(gen uint64, success *bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.generation {
+		return
+	}
+	now := b.now()
+	if b.state == stateHalfOpen {
+		b.inFlight--
+		switch {
+		case success == nil:
+		case !*success:
+			b.setState(stateOpen, now)
+		default:
+			b.successes++
+			if b.successes >= b.cfg.HalfOpenRequests {
+				b.setState(stateClosed, now)
+			}
+		}
+		return
+	}
+	if success == nil {
+		b.requests--
+		return
+	}
+	if *success {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	ratioTripped := b.requests >= b.cfg.MinRequests && float64(b.failures)/float64(b.requests) >= b.cfg.FailureRatio
+	if b.consecutive >= b.cfg.ConsecutiveFailures || ratioTripped {
+		b.setState(stateOpen, now)
+	}
+}
+
+func (b *circuitBreaker) setState(s breakerState, now time.Time) {
+	if b.state == s {
+		return
+	}
+	prev := b.state
+	b.state = s
+	b.generation++
+	b.resetCounts(now)
+	b.inFlight, b.successes = 0, 0
+	if s == stateOpen {
+		b.openedAt = now
+	}
+	log.Warn().Str("upstream", b.name).Str("from", prev.String()).Str("to", s.String()).Msg("circuit_state_change")
+}
+
+func (b *circuitBreaker) resetCounts(now time.Time) {
+	b.windowStart = now
+	b.requests, b.failures, b.consecutive = 0, 0, 0
+}
+
+func (b *circuitBreaker) setConfig(cfg BreakerConfig) {
+	b.mu.Lock()
+	b.cfg = cfg.withDefaults()
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) snapshot() gin.H {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := gin.H{
+		"upstream":             b.name,
+		"state":                b.state.String(),
+		"requests":             b.requests,
+		"failures":             b.failures,
+		"consecutive_failures": b.consecutive,
+	}
+	if b.state != stateClosed {
+		h["opened_at"] = b.openedAt
+	}
+	return h
+}
+
+// breakerTransport guards an upstream with its circuit breaker. Transport
+// errors and 502/503/504 responses count as failures.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	gen, err := t.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	var ok *bool
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+	case err != nil:
+		ok = new(bool)
+	default:
+		success := resp.StatusCode != http.StatusBadGateway &&
+			resp.StatusCode != http.StatusServiceUnavailable &&
+			resp.StatusCode != http.StatusGatewayTimeout
+		ok = &success
+	}
+	t.breaker.record(gen, ok)
+	return resp, err
+}
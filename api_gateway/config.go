@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigYAML is used when GATEWAY_CONFIG is not set. It reproduces the
+// historical users/orders routing driven by USERS_URL and ORDERS_URL.
+//
+//go:embed gateway.yaml
+var defaultConfigYAML []byte
+
+// Config is the declarative description of everything the gateway proxies.
+type Config struct {
+	Upstreams  map[string]UpstreamConfig  `yaml:"upstreams"`
+	RateLimits map[string]RateLimitConfig `yaml:"rate_limits"`
+	Routes     []RouteConfig              `yaml:"routes"`
+
+	source string // file path, or "builtin"
+	hash   string // sha256 of the expanded file, identifies the config version
+}
+
+// UpstreamConfig is a named backend service. A target may hold several
+// comma separated URLs, so a single ${USERS_URL} can describe a whole pool.
+type UpstreamConfig struct {
+	Targets     []string          `yaml:"targets"`
+	Balance     string            `yaml:"balance"` // round_robin (default), least_conn or consistent_hash
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Breaker     BreakerConfig     `yaml:"breaker"`
+	RetryBudget RetryBudgetConfig `yaml:"retry_budget"`
+}
+
+// RateLimitConfig is either a mapping with rate and burst or the compact
+// "rate:burst" string also accepted by the RATE_LIMIT_* variables.
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (rl *RateLimitConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		p, err := parseRateLimitPolicy("", node.Value, RateLimitPolicy{})
+		if err != nil {
+			return err
+		}
+		rl.Rate, rl.Burst = p.Rate, p.Burst
+		return nil
+	}
+	type plain RateLimitConfig
+	return node.Decode((*plain)(rl))
+}
+
+// RouteConfig maps a path prefix to an upstream.
+type RouteConfig struct {
+	Name      string        `yaml:"name"`
+	Prefix    string        `yaml:"prefix"`
+	Upstream  string        `yaml:"upstream"`
+	Auth      *bool         `yaml:"auth"`  // defaults to true
+	Roles     []string      `yaml:"roles"` // any of these roles is enough
+	Timeout   time.Duration `yaml:"timeout"`
+	RateLimit string        `yaml:"rate_limit"`
+	Rewrite   RewriteConfig `yaml:"rewrite"`
+	Retry     RetryConfig   `yaml:"retry"`
+}
+
+// RewriteConfig changes the path before it is sent upstream. Steps are
+// applied in field order.
+type RewriteConfig struct {
+	StripPrefix string `yaml:"strip_prefix"`
+	AddPrefix   string `yaml:"add_prefix"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+func (rc RouteConfig) authRequired() bool {
+	return rc.Auth == nil || *rc.Auth
+}
+
+// LoadConfig reads the gateway config at path, or the built in default when
+// path is empty.
+func LoadConfig(path string) (*Config, error) {
+	data, source := defaultConfigYAML, "builtin"
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config: %w", err)
+		}
+		data, source = b, path
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg.source = source
+	return cfg, nil
+}
+
+// ParseConfig expands ${VAR} and ${VAR:-default} references, decodes the
+// YAML and validates the result.
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	expanded := expandEnv(string(data))
+	dec := yaml.NewDecoder(strings.NewReader(expanded))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	cfg.splitTargets()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(expanded))
+	cfg.hash = hex.EncodeToString(sum[:])
+	return &cfg, nil
+}
+
+func (cfg *Config) splitTargets() {
+	for name, u := range cfg.Upstreams {
+		var targets []string
+		for _, t := range u.Targets {
+			targets = append(targets, splitList(t)...)
+		}
+		u.Targets = targets
+		cfg.Upstreams[name] = u
+	}
+}
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv only understands the braced form so that "$1" in rewrite
+// replacements is left alone.
+func expandEnv(s string) string {
+	return envRef.ReplaceAllStringFunc(s, func(m string) string {
+		sub := envRef.FindStringSubmatch(m)
+		if v := os.Getenv(sub[1]); v != "" {
+			return v
+		}
+		return sub[3]
+	})
+}
+
+// Validate reports every problem in the config at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if len(cfg.Routes) == 0 {
+		errs = append(errs, errors.New("no routes configured"))
+	}
+	for name, u := range cfg.Upstreams {
+		if len(u.Targets) == 0 {
+			errs = append(errs, fmt.Errorf("upstream %q: no targets", name))
+		}
+		for _, t := range u.Targets {
+			if pu, err := url.Parse(t); err != nil || pu.Scheme == "" || pu.Host == "" {
+				errs = append(errs, fmt.Errorf("upstream %q: invalid target %q", name, t))
+			}
+		}
+		if err := u.Breaker.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("upstream %q: %w", name, err))
+		}
+		if err := u.RetryBudget.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("upstream %q: %w", name, err))
+		}
+		if err := validateBalance(u.Balance); err != nil {
+			errs = append(errs, fmt.Errorf("upstream %q: %w", name, err))
+		}
+		if err := u.HealthCheck.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("upstream %q: %w", name, err))
+		}
+	}
+	for name, rl := range cfg.RateLimits {
+		if rl.Rate <= 0 || rl.Burst <= 0 {
+			errs = append(errs, fmt.Errorf("rate limit %q: rate and burst must be positive", name))
+		}
+	}
+	names := map[string]bool{}
+	prefixes := map[string]bool{}
+	for i, rc := range cfg.Routes {
+		label := rc.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i)
+			errs = append(errs, fmt.Errorf("route %s: name is required", label))
+		} else if names[rc.Name] {
+			errs = append(errs, fmt.Errorf("route %s: duplicate name", label))
+		}
+		names[rc.Name] = true
+		if !strings.HasPrefix(rc.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("route %s: prefix must start with /", label))
+		} else if prefixes[rc.Prefix] {
+			errs = append(errs, fmt.Errorf("route %s: duplicate prefix %q", label, rc.Prefix))
+		}
+		prefixes[rc.Prefix] = true
+		if _, ok := cfg.Upstreams[rc.Upstream]; !ok {
+			errs = append(errs, fmt.Errorf("route %s: unknown upstream %q", label, rc.Upstream))
+		}
+		if rc.RateLimit != "" {
+			if _, ok := cfg.RateLimits[rc.RateLimit]; !ok {
+				errs = append(errs, fmt.Errorf("route %s: unknown rate limit %q", label, rc.RateLimit))
+			}
+		}
+		if rc.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("route %s: negative timeout", label))
+		}
+		if err := rc.Retry.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", label, err))
+		}
+		if rc.Rewrite.Regex != "" {
+			if _, err := regexp.Compile(rc.Rewrite.Regex); err != nil {
+				errs = append(errs, fmt.Errorf("route %s: rewrite regex: %w", label, err))
+			}
+		}
+		if rc.Rewrite.AddPrefix != "" && !strings.HasPrefix(rc.Rewrite.AddPrefix, "/") {
+			errs = append(errs, fmt.Errorf("route %s: add_prefix must start with /", label))
+		}
+	}
+	return errors.Join(errs...)
+}
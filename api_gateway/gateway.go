@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const defaultRouteTimeout = 10 * time.Second
+
+// upstream is a compiled UpstreamConfig.
+type upstream struct {
+	name      string
+	balance   string
+	cfg       UpstreamConfig
+	targets   []*url.URL
+	state     *upstreamState
+	transport http.RoundTripper
+}
+
+// upstreamState is the runtime state of an upstream that has to survive
+// config reloads, so that for example a reload does not close a breaker for
+// an upstream that is still down.
+type upstreamState struct {
+	pool    *targetPool
+	breaker *circuitBreaker
+	budget  *retryBudget
+}
+
+type upstreamRegistry struct {
+	healthTransport http.RoundTripper
+
+	mu     sync.Mutex
+	states map[string]*upstreamState
+}
+
+func newUpstreamRegistry(healthTransport http.RoundTripper) *upstreamRegistry {
+	return &upstreamRegistry{healthTransport: healthTransport, states: map[string]*upstreamState{}}
+}
+
+// lookup returns the state kept for name, or a new one that is not
+// registered yet. It changes nothing, so a table built from it can still be
+// thrown away.
+func (r *upstreamRegistry) lookup(name string, uc UpstreamConfig) *upstreamState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.states[name]; ok {
+		return st
+	}
+	return &upstreamState{
+		pool:    newTargetPool(name, r.healthTransport),
+		breaker: newCircuitBreaker(name, uc.Breaker),
+		budget:  newRetryBudget(uc.RetryBudget),
+	}
+}
+
+// apply registers ups and brings their state up to date with their config.
+// It is only called for a table that is about to become active.
+func (r *upstreamRegistry) apply(ups map[string]*upstream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, u := range ups {
+		if st, ok := r.states[name]; ok && st == u.state {
+			st.breaker.setConfig(u.cfg.Breaker)
+			st.budget.setConfig(u.cfg.RetryBudget)
+		} else {
+			if ok {
+				st.pool.close()
+			}
+			r.states[name] = u.state
+		}
+		u.state.pool.update(u.targets, u.cfg.Balance, u.cfg.HealthCheck)
+	}
+}
+
+// prune forgets upstreams that are not in keep and stops their health
+// checks. It runs once the table without them is active.
+func (r *upstreamRegistry) prune(keep map[string]*upstream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, st := range r.states {
+		if _, ok := keep[name]; !ok {
+			st.pool.close()
+			delete(r.states, name)
+		}
+	}
+}
+
+func (r *upstreamRegistry) snapshot() []gin.H {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.states))
+	for n := range r.states {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	states := make([]*upstreamState, 0, len(names))
+	for _, n := range names {
+		states = append(states, r.states[n])
+	}
+	r.mu.Unlock()
+	out := make([]gin.H, 0, len(states))
+	for _, st := range states {
+		out = append(out, gin.H{"upstream": st.breaker.name, "targets": st.pool.snapshot(), "breaker": st.breaker.snapshot()})
+	}
+	return out
+}
+
+// route is a compiled RouteConfig.
+type route struct {
+	RouteConfig
+	upstream  *upstream
+	policy    *RateLimitPolicy
+	rewriteRe *regexp.Regexp
+	transport http.RoundTripper
+	proxy     *httputil.ReverseProxy
+}
+
+// matches reports whether path falls under the route prefix on a segment
+// boundary, so /v1/users does not match /v1/usersettings.
+func (rt *route) matches(path string) bool {
+	p := strings.TrimSuffix(rt.Prefix, "/")
+	return path == p || strings.HasPrefix(path, p+"/") || (p == "" && strings.HasPrefix(path, "/"))
+}
+
+func (rt *route) rewritePath(path string) string {
+	rw := rt.Rewrite
+	if rw.StripPrefix != "" && strings.HasPrefix(path, rw.StripPrefix) {
+		path = strings.TrimPrefix(path, rw.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if rw.AddPrefix != "" {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + path
+	}
+	if rt.rewriteRe != nil {
+		path = rt.rewriteRe.ReplaceAllString(path, rw.Replacement)
+	}
+	return path
+}
+
+// routeTable holds routes ordered by descending prefix length so the first
+// match is the most specific one. A table is immutable once built; reloads
+// swap in a new one while in-flight requests finish on the old.
+type routeTable struct {
+	routes    []*route
+	upstreams map[string]*upstream
+	version   configVersion
+}
+
+func (t *routeTable) match(path string) *route {
+	for _, rt := range t.routes {
+		if rt.matches(path) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// buildRouteTable compiles cfg without touching shared state: upstream
+// config only takes effect when the table is activated.
+func buildRouteTable(cfg *Config, transport http.RoundTripper, states *upstreamRegistry) (*routeTable, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	upstreams := map[string]*upstream{}
+	for name, uc := range cfg.Upstreams {
+		var targets []*url.URL
+		for _, t := range uc.Targets {
+			pu, err := url.Parse(t)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %q: %w", name, err)
+			}
+			targets = append(targets, pu)
+		}
+		u := &upstream{name: name, balance: uc.Balance, cfg: uc, targets: targets, state: states.lookup(name, uc)}
+		u.transport = &breakerTransport{
+			next:    &balancerTransport{next: transport, pool: u.state.pool},
+			breaker: u.state.breaker,
+		}
+		upstreams[name] = u
+	}
+	t := &routeTable{upstreams: upstreams, version: configVersion{Hash: cfg.hash, Source: cfg.source, LoadedAt: time.Now()}}
+	for _, rc := range cfg.Routes {
+		rt := &route{RouteConfig: rc, upstream: upstreams[rc.Upstream]}
+		if rt.Timeout == 0 {
+			rt.Timeout = defaultRouteTimeout
+		}
+		if rc.RateLimit != "" {
+			rl := cfg.RateLimits[rc.RateLimit]
+			rt.policy = &RateLimitPolicy{Name: rc.RateLimit, Rate: rl.Rate, Burst: rl.Burst}
+		}
+		if rc.Rewrite.Regex != "" {
+			rt.rewriteRe = regexp.MustCompile(rc.Rewrite.Regex)
+		}
+		rt.transport = &retryTransport{
+			next:   rt.upstream.transport,
+			cfg:    rc.Retry.withDefaults(),
+			budget: rt.upstream.state.budget,
+			route:  rc.Name,
+		}
+		rt.proxy = newRouteProxy(rt)
+		t.routes = append(t.routes, rt)
+	}
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return len(t.routes[i].Prefix) > len(t.routes[j].Prefix)
+	})
+	return t, nil
+}
+
+// Gateway dispatches every request through the active route table.
+type Gateway struct {
+	table     atomic.Pointer[routeTable]
+	limiter   LimiterStore
+	apiKeys   map[string]bool
+	upstreams *upstreamRegistry
+
+	configPath string
+	reloadMu   sync.Mutex
+	versions   int64
+	lastError  error
+}
+
+// ServeGin is mounted as the engine's NoRoute handler so that the route table
+// rather than gin decides which paths exist.
+func (g *Gateway) ServeGin(c *gin.Context) {
+	rt := g.table.Load().match(c.Request.URL.Path)
+	if rt == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "no route"}})
+		return
+	}
+	if rt.policy != nil && !g.rateLimit(c, *rt.policy) {
+		return
+	}
+	stripIdentity(c.Request.Header)
+	if rt.authRequired() {
+		claims, ok := authorize(c, rt.Roles)
+		if !ok {
+			return
+		}
+		sub, _ := claims["sub"].(string)
+		setIdentity(c.Request.Header, sub, claimRoles(claims))
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), rt.Timeout)
+	defer cancel()
+	if rt.upstream.balance == balanceConsistentHash {
+		ctx = withBalanceKey(ctx, rateLimitKey(c, g.apiKeys))
+	}
+	c.Request = c.Request.WithContext(ctx)
+	proxyTo(c, rt)
+}
+
+// authorize checks the bearer token and, when roles is not empty, that the
+// caller holds one of them. It returns the token claims, or aborts the
+// request and returns false on failure.
+func authorize(c *gin.Context, roles []string) (jwt.MapClaims, bool) {
+	auth := c.GetHeader("Authorization")
+	if auth == "" {
+		c.AbortWithStatusJSON(401, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "token required"}})
+		return nil, false
+	}
+	claims, ok := parseJWT(auth)
+	if !ok {
+		c.AbortWithStatusJSON(401, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "invalid token"}})
+		return nil, false
+	}
+	if revocations.revoked(claims) {
+		c.AbortWithStatusJSON(401, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "token revoked"}})
+		return nil, false
+	}
+	if len(roles) > 0 && !hasAnyRole(claimRoles(claims), roles) {
+		c.AbortWithStatusJSON(403, gin.H{"success": false, "error": gin.H{"code": "forbidden", "message": "insufficient role"}})
+		return nil, false
+	}
+	return claims, true
+}
+
+func hasAnyRole(have, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adminOnly guards the gateway's own admin endpoints.
+func adminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authorize(c, []string{"admin"}); !ok {
+			return
+		}
+		c.Next()
+	}
+}
+
+// RegisterProxyRoutes builds the gateway for cfg and mounts it on r.
+func RegisterProxyRoutes(r *gin.Engine, cfg *Config) (*Gateway, error) {
+	upstreams := newUpstreamRegistry(upstreamTransport)
+	table, err := buildRouteTable(cfg, upstreamTransport, upstreams)
+	if err != nil {
+		return nil, err
+	}
+	idleTTL, err := time.ParseDuration(getEnv("RATE_LIMIT_IDLE_TTL", "10m"))
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT_IDLE_TTL: %w", err)
+	}
+	limiter, err := newLimiterStore(getEnv("RATE_LIMIT_BACKEND", "memory"), getEnv("REDIS_URL", "redis://redis:6379/0"), idleTTL)
+	if err != nil {
+		return nil, err
+	}
+	g := &Gateway{limiter: limiter, apiKeys: parseAPIKeys(getEnv("API_KEYS", "")), upstreams: upstreams}
+	if cfg.source != "builtin" {
+		g.configPath = cfg.source
+	}
+	g.activate(table)
+	r.NoRoute(g.ServeGin)
+
+	admin := r.Group("/admin", adminOnly())
+	admin.GET("/config", g.handleConfigInfo)
+	admin.POST("/config/reload", g.handleConfigReload)
+	admin.GET("/upstreams", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": g.upstreams.snapshot()})
+	})
+	return g, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity headers the gateway sends downstream after it has verified the
+// caller. Services in AUTH_MODE=gateway trust them instead of re-parsing the
+// JWT, so they only need INTERNAL_AUTH_KEY, not the user-facing secret.
+const (
+	headerUserID            = "X-User-ID"
+	headerUserRoles         = "X-User-Roles"
+	headerIdentityTimestamp = "X-Identity-Timestamp"
+	headerIdentitySignature = "X-Identity-Signature"
+)
+
+var internalAuthKey = []byte(getEnv("INTERNAL_AUTH_KEY", ""))
+
+// stripIdentity removes client supplied identity headers; only the gateway
+// may set them.
+func stripIdentity(h http.Header) {
+	for _, k := range []string{headerUserID, headerUserRoles, headerIdentityTimestamp, headerIdentitySignature} {
+		h.Del(k)
+	}
+}
+
+// setIdentity adds the verified caller to h, signed with internalAuthKey.
+// Without a key nothing is sent and services have to fall back to the JWT.
+func setIdentity(h http.Header, sub string, roles []string) {
+	if len(internalAuthKey) == 0 || sub == "" {
+		return
+	}
+	joined := strings.Join(roles, ",")
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set(headerUserID, sub)
+	h.Set(headerUserRoles, joined)
+	h.Set(headerIdentityTimestamp, ts)
+	h.Set(headerIdentitySignature, signIdentity(internalAuthKey, sub, joined, ts))
+}
+
+// signIdentity is HMAC-SHA256 over the identity fields. The services compute
+// the same value, keep the two in sync.
+func signIdentity(key []byte, sub, roles, ts string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("v1\n" + sub + "\n" + roles + "\n" + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,1096 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+func newUpstream(t *testing.T, h http.Handler) string {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// setupGatewayTest serves the built in route table with users and orders
+// pointed at the given upstreams.
+func setupGatewayTest(t *testing.T, usersURL, ordersURL string) *httptest.Server {
+	t.Setenv("USERS_URL", usersURL)
+	t.Setenv("ORDERS_URL", ordersURL)
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	return setupGatewayWithConfig(t, cfg)
+}
+
+func setupGatewayWithConfig(t *testing.T, cfg *Config) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(recoverPanics())
+	r.Use(RequestID())
+	r.Use(CORSMiddleware())
+	if _, err := RegisterProxyRoutes(r, cfg); err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	gw := httptest.NewServer(r)
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+// testKeys is the key set served as the users service JWKS in tests;
+// tokenFor signs with testKeys["test"].
+var (
+	testKeysMu sync.Mutex
+	testKeys   = map[string]ed25519.PrivateKey{}
+)
+
+func TestMain(m *testing.M) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	testKeys["test"] = priv
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testKeysMu.Lock()
+		defer testKeysMu.Unlock()
+		var keys []gin.H
+		for kid, k := range testKeys {
+			x := base64.RawURLEncoding.EncodeToString(k.Public().(ed25519.PublicKey))
+			keys = append(keys, gin.H{"kid": kid, "kty": "OKP", "crv": "Ed25519", "alg": "EdDSA", "x": x})
+		}
+		json.NewEncoder(w).Encode(gin.H{"keys": keys})
+	}))
+	jwks = newJWKSCache(srv.URL, "5m")
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
+}
+
+func signToken(t *testing.T, kid string, claims jwt.MapClaims) string {
+	testKeysMu.Lock()
+	priv := testKeys[kid]
+	testKeysMu.Unlock()
+	tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	tok.Header["kid"] = kid
+	s, err := tok.SignedString(priv)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return s
+}
+
+func tokenFor(t *testing.T, sub string, roles []string) string {
+	return signToken(t, "test", jwt.MapClaims{
+		"sub":   sub,
+		"roles": roles,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+func TestProxyStripsHopByHopAndSetsForwardedHeaders(t *testing.T) {
+	var got http.Header
+	users := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusCreated)
+	})
+	gw := setupGatewayTest(t, newUpstream(t, users), newUpstream(t, http.NotFoundHandler()))
+
+	req, _ := http.NewRequest(http.MethodPost, gw.URL+"/v1/users/register?x=1", strings.NewReader(`{}`))
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "secret")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("X-Forwarded-For", "10.0.0.99")
+	req.Header.Set("X-Request-ID", "rid-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 got %d", resp.StatusCode)
+	}
+
+	if got.Get("X-Client-Hop") != "" {
+		t.Fatalf("hop-by-hop header named in Connection was forwarded")
+	}
+	if got.Get("Te") != "trailers" {
+		t.Fatalf("expected Te to be reduced to trailers, got %q", got.Get("Te"))
+	}
+	if xff := got.Get("X-Forwarded-For"); xff == "" || !strings.HasSuffix(xff, "127.0.0.1") {
+		t.Fatalf("unexpected X-Forwarded-For %q", xff)
+	}
+	if got.Get("X-Forwarded-Proto") != "http" || got.Get("X-Forwarded-Host") == "" {
+		t.Fatalf("missing X-Forwarded-Proto/Host: %v", got)
+	}
+	if fwd := got.Get("Forwarded"); !strings.Contains(fwd, "for=127.0.0.1") || !strings.Contains(fwd, "proto=http") {
+		t.Fatalf("unexpected Forwarded %q", fwd)
+	}
+	if got.Get("X-Request-ID") != "rid-1" {
+		t.Fatalf("expected request id to be propagated, got %q", got.Get("X-Request-ID"))
+	}
+	if resp.Header.Get("X-Upstream-Hop") != "" || resp.Header.Get("Keep-Alive") != "" {
+		t.Fatalf("hop-by-hop response headers leaked to client: %v", resp.Header)
+	}
+}
+
+func TestProxyStreamsChunkedResponsesWithTrailers(t *testing.T) {
+	release := make(chan struct{})
+	orders := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second\n")
+		w.Header().Set("X-Checksum", "abc")
+	})
+	gw := setupGatewayTest(t, newUpstream(t, http.NotFoundHandler()), newUpstream(t, orders))
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/v1/orders/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenFor(t, "u1", nil))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// the first chunk must arrive before the upstream finishes the response
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("expected first chunk to be streamed, got %q err=%v", line, err)
+	}
+	close(release)
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("read rest: %v", err)
+	}
+	if string(rest) != "second\n" {
+		t.Fatalf("unexpected tail %q", rest)
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Fatalf("expected trailer to be forwarded, got %v", resp.Trailer)
+	}
+}
+
+func TestProxyStreamsRequestBody(t *testing.T) {
+	const size = 4 << 20
+	var received int64
+	orders := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received = n
+		w.WriteHeader(http.StatusOK)
+	})
+	gw := setupGatewayTest(t, newUpstream(t, http.NotFoundHandler()), newUpstream(t, orders))
+
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := make([]byte, 64<<10)
+		for written := 0; written < size; written += len(chunk) {
+			pw.Write(chunk)
+		}
+		pw.Close()
+	}()
+	req, _ := http.NewRequest(http.MethodPost, gw.URL+"/v1/orders/", pr)
+	req.Header.Set("Authorization", "Bearer "+tokenFor(t, "u1", nil))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || received != size {
+		t.Fatalf("expected %d bytes upstream, got %d (status %d)", size, received, resp.StatusCode)
+	}
+}
+
+func TestProxyUnreachableUpstreamReturnsBadGateway(t *testing.T) {
+	// point both upstreams at a closed listener
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	gw := setupGatewayTest(t, dead.URL, dead.URL)
+
+	resp, err := http.Post(gw.URL+"/v1/users/login", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "bad_gateway") {
+		t.Fatalf("expected 502 bad_gateway, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestRateLimitBudgetsArePerCallerAndPerService(t *testing.T) {
+	t.Setenv("RATE_LIMIT_ORDERS", "0.01:2")
+	t.Setenv("API_KEYS", "k-partner")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	gw := setupGatewayTest(t, newUpstream(t, ok), newUpstream(t, ok))
+
+	do := func(path string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	alice := map[string]string{"Authorization": "Bearer " + tokenFor(t, "alice", nil)}
+	bob := map[string]string{"Authorization": "Bearer " + tokenFor(t, "bob", nil)}
+
+	for i := 0; i < 2; i++ {
+		resp := do("/v1/orders/", alice)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: expected 200 got %d", i, resp.StatusCode)
+		}
+		if resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Fatalf("unexpected rate limit headers: %v", resp.Header)
+		}
+	}
+	resp := do("/v1/orders/", alice)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 got %d", resp.StatusCode)
+	}
+	if ra, _ := strconv.Atoi(resp.Header.Get("Retry-After")); ra <= 0 {
+		t.Fatalf("expected positive Retry-After, got %q", resp.Header.Get("Retry-After"))
+	}
+	if resp.Header.Get("RateLimit-Remaining") != "0" || resp.Header.Get("RateLimit-Reset") == "" {
+		t.Fatalf("expected rate limit headers on 429: %v", resp.Header)
+	}
+
+	// another user and the users service keep their own budgets
+	if resp := do("/v1/orders/", bob); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected bob to be unaffected, got %d", resp.StatusCode)
+	}
+	if resp := do("/v1/users/me", alice); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected users budget to be separate, got %d", resp.StatusCode)
+	}
+	// a known API key gets its own bucket, an unknown one falls back to the IP
+	key := map[string]string{"X-API-Key": "k-partner", "Authorization": alice["Authorization"]}
+	if resp := do("/v1/orders/", key); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected API key bucket to be separate, got %d", resp.StatusCode)
+	}
+}
+
+func TestLimiterRegistryEvictsIdleRefilledEntries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	reg := newLimiterRegistry(time.Minute)
+	reg.now = func() time.Time { return now }
+	p := RateLimitPolicy{Name: "users", Rate: 1, Burst: 5}
+
+	for i := 0; i < 5; i++ {
+		reg.take("ip:1", p)
+	}
+	if res := reg.take("ip:1", p); res.Allowed {
+		t.Fatalf("expected bucket to be exhausted")
+	}
+	reg.take("ip:2", p)
+
+	now = now.Add(2 * time.Minute)
+	reg.take("ip:3", p)
+	if n := reg.size(); n != 1 {
+		t.Fatalf("expected idle entries to be evicted, %d left", n)
+	}
+}
+
+func TestRedisLimiterStoreIsSharedBetweenReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	p := RateLimitPolicy{Name: "orders", Rate: 1, Burst: 3}
+	replicaA := newRedisLimiterStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	replicaB := newRedisLimiterStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	ctx := context.Background()
+
+	for i, store := range []LimiterStore{replicaA, replicaB, replicaA} {
+		res, err := store.Take(ctx, "user:alice", p)
+		if err != nil {
+			t.Fatalf("take %d: %v", i, err)
+		}
+		if !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("take %d: expected allowed with %d remaining, got %+v", i, 2-i, res)
+		}
+	}
+	res, err := replicaB.Take(ctx, "user:alice", p)
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	if res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > time.Second {
+		t.Fatalf("expected shared budget to be exhausted, got %+v", res)
+	}
+	if res, _ := replicaB.Take(ctx, "user:bob", p); !res.Allowed {
+		t.Fatalf("expected other keys to keep their own budget")
+	}
+}
+
+func TestGatewayUsesRedisBackendFromEnv(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("RATE_LIMIT_BACKEND", "redis")
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr()+"/0")
+	t.Setenv("RATE_LIMIT_USERS", "0.01:1")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	usersURL := newUpstream(t, ok)
+	replicaA := setupGatewayTest(t, usersURL, usersURL)
+	replicaB := setupGatewayTest(t, usersURL, usersURL)
+
+	resp, err := http.Post(replicaA.URL+"/v1/users/login", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", resp.StatusCode)
+	}
+	resp, err = http.Post(replicaB.URL+"/v1/users/login", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected second replica to share the budget, got %d", resp.StatusCode)
+	}
+}
+
+func TestConfigDrivenRoutesRewriteAndRoles(t *testing.T) {
+	var gotPath string
+	inventory := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.RequestURI()
+		w.WriteHeader(http.StatusOK)
+	})
+	t.Setenv("INVENTORY_URL", newUpstream(t, inventory))
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+  inventory:
+    targets: ["${INVENTORY_URL}"]
+rate_limits:
+  inventory: {rate: 100, burst: 100}
+routes:
+  - name: inventory-public
+    prefix: /v1/inventory/public
+    upstream: inventory
+    auth: false
+    rewrite:
+      strip_prefix: /v1/inventory/public
+      add_prefix: /api/catalog
+  - name: inventory-admin
+    prefix: /v1/inventory
+    upstream: inventory
+    roles: [admin]
+    timeout: 2s
+    rate_limit: inventory
+    rewrite:
+      regex: ^/v1/inventory/(.*)$
+      replacement: /internal/$1
+`))
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	gw := setupGatewayWithConfig(t, cfg)
+
+	get := func(path, token string) int {
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("/v1/inventory/public/items?q=1", ""); code != http.StatusOK || gotPath != "/api/catalog/items?q=1" {
+		t.Fatalf("public route: got %d %q", code, gotPath)
+	}
+	if code := get("/v1/inventory/stock", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", code)
+	}
+	if code := get("/v1/inventory/stock", tokenFor(t, "u1", []string{"user"})); code != http.StatusForbidden {
+		t.Fatalf("expected 403 without admin role, got %d", code)
+	}
+	if code := get("/v1/inventory/stock", tokenFor(t, "u2", []string{"admin"})); code != http.StatusOK || gotPath != "/internal/stock" {
+		t.Fatalf("admin route: got %d %q", code, gotPath)
+	}
+	if code := get("/v1/inventoryx", ""); code != http.StatusNotFound {
+		t.Fatalf("expected prefix to match on segment boundary, got %d", code)
+	}
+}
+
+func TestRouteTimeoutCanExceedTransportDefaults(t *testing.T) {
+	// the production transport with every fixed limit cut a hundredfold, so
+	// a limit there that would cap the route timeout shows up in milliseconds
+	tr := newUpstreamTransport()
+	for _, d := range []*time.Duration{&tr.IdleConnTimeout, &tr.TLSHandshakeTimeout, &tr.ResponseHeaderTimeout, &tr.ExpectContinueTimeout} {
+		*d /= 100
+	}
+	prev := upstreamTransport
+	upstreamTransport = tr
+	t.Cleanup(func() { upstreamTransport = prev })
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+		}
+	})
+	t.Setenv("SLOW_URL", newUpstream(t, slow))
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+  slow:
+    targets: ["${SLOW_URL}"]
+routes:
+  - name: slow-long
+    prefix: /v1/slow/long
+    upstream: slow
+    auth: false
+    timeout: 2s
+  - name: slow-short
+    prefix: /v1/slow/short
+    upstream: slow
+    auth: false
+    timeout: 100ms
+`))
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	gw := setupGatewayWithConfig(t, cfg)
+
+	resp, err := http.Get(gw.URL + "/v1/slow/short")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 past a short route timeout, got %d", resp.StatusCode)
+	}
+	// a route timeout above the transport's limits is honoured, not capped
+	resp, err = http.Get(gw.URL + "/v1/slow/long")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 within the route timeout, got %d", resp.StatusCode)
+	}
+}
+
+func TestConfigValidationReportsAllErrors(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+upstreams:
+  users:
+    targets: ["not a url"]
+routes:
+  - name: a
+    prefix: v1/a
+    upstream: missing
+    rate_limit: nope
+  - name: a
+    prefix: /v1/b
+    upstream: users
+    rewrite: {regex: "("}
+`))
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"invalid target", "prefix must start with /", "unknown upstream", "unknown rate limit", "duplicate name", "rewrite regex"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %v", want, err)
+		}
+	}
+	if _, err := ParseConfig([]byte("routes: []\nunknown_key: 1\n")); err == nil {
+		t.Fatalf("expected unknown keys to be rejected")
+	}
+}
+
+// eventually polls cond for up to three seconds.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func writeConfig(t *testing.T, path, upstreamURL, extra string) {
+	t.Helper()
+	data := `
+upstreams:
+  users:
+    targets: ["` + upstreamURL + `"]
+routes:
+  - name: users
+    prefix: /v1/users
+    upstream: users
+    auth: false
+` + extra
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
+
+func TestConfigHotReloadSwapsRoutesAndRejectsInvalidConfig(t *testing.T) {
+	first := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "first") }))
+	second := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "second") }))
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, first, "")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestID())
+	g, err := RegisterProxyRoutes(r, cfg)
+	if err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go g.WatchConfig(ctx)
+
+	body := func() string {
+		resp, err := http.Get(srv.URL + "/v1/users/me")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	if got := body(); got != "first" {
+		t.Fatalf("expected first upstream, got %q", got)
+	}
+
+	// editing the file switches upstream without a restart
+	writeConfig(t, path, second, "")
+	if !eventually(func() bool { return body() == "second" }) {
+		t.Fatalf("config change was not picked up")
+	}
+	if v := g.table.Load().version.Version; v != 2 {
+		t.Fatalf("expected config version 2, got %d", v)
+	}
+	// other files next to the config do not trigger a reload
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "notes.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if v := g.table.Load().version.Version; v != 2 {
+		t.Fatalf("expected unrelated file to be ignored, got config version %d", v)
+	}
+
+	// an invalid config is rejected and the previous table keeps serving
+	writeConfig(t, path, second, "  - name: broken\n    prefix: nope\n    upstream: missing\n")
+	if err := g.Reload("test"); err == nil {
+		t.Fatalf("expected invalid config to be rejected")
+	}
+	if got := body(); got != "second" {
+		t.Fatalf("expected previous config to stay active, got %q", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenFor(t, "root", []string{"admin"}))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("admin request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Data struct {
+			Active    configVersion `json:"active"`
+			LastError string        `json:"last_reload_error"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if info.Data.Active.Version != 2 || info.Data.Active.Source != path || !strings.Contains(info.Data.LastError, "unknown upstream") {
+		t.Fatalf("unexpected admin config info: %+v", info.Data)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenFor(t, "u1", []string{"user"}))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("admin request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected admin endpoint to require admin role, got %d", resp.StatusCode)
+	}
+}
+
+func TestRouteTableBuildHasNoSideEffects(t *testing.T) {
+	up := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeConfig(t, path, up, "")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gin.SetMode(gin.TestMode)
+	g, err := RegisterProxyRoutes(gin.New(), cfg)
+	if err != nil {
+		t.Fatalf("register routes: %v", err)
+	}
+	users := g.upstreams.states["users"]
+
+	// a table that is built but never activated changes nothing shared
+	next, err := ParseConfig([]byte(`
+upstreams:
+  orders:
+    targets: ["` + up + `"]
+routes:
+  - name: orders
+    prefix: /v1/orders
+    upstream: orders
+    auth: false
+`))
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	table, err := buildRouteTable(next, upstreamTransport, g.upstreams)
+	if err != nil {
+		t.Fatalf("build table: %v", err)
+	}
+	if _, ok := g.upstreams.states["orders"]; ok || g.upstreams.states["users"] != users {
+		t.Fatalf("building a table changed the upstream registry: %v", g.upstreams.states)
+	}
+
+	// activating swaps it in and only then drops the old upstream
+	old := g.table.Load()
+	g.activate(table)
+	if g.table.Load() != table || g.upstreams.states["orders"] != table.upstreams["orders"].state {
+		t.Fatalf("expected the new table and its upstream to be active")
+	}
+	if _, ok := g.upstreams.states["users"]; ok {
+		t.Fatalf("expected the dropped upstream to be pruned")
+	}
+	if old.match("/v1/users/me") == nil {
+		t.Fatalf("expected the old table to stay intact for in-flight requests")
+	}
+}
+
+func TestCircuitBreakerFailsFastAndRecovers(t *testing.T) {
+	var hits atomic.Int32
+	var healthy atomic.Bool
+	orders := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	t.Setenv("ORDERS_URL", newUpstream(t, orders))
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+  orders:
+    targets: ["${ORDERS_URL}"]
+    breaker:
+      consecutive_failures: 3
+      cooldown: 150ms
+routes:
+  - name: orders
+    prefix: /v1/orders
+    upstream: orders
+    auth: false
+`))
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	gw := setupGatewayWithConfig(t, cfg)
+	get := func() (*http.Response, string) {
+		resp, err := http.Get(gw.URL + "/v1/orders/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp, _ := get(); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected upstream 503 to pass through, got %d", resp.StatusCode)
+		}
+	}
+	resp, body := get()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "upstream_unavailable") {
+		t.Fatalf("expected breaker to fail fast, got %d %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After on open breaker")
+	}
+	if n := hits.Load(); n != 3 {
+		t.Fatalf("expected open breaker to stop upstream calls, upstream saw %d", n)
+	}
+
+	healthy.Store(true)
+	time.Sleep(200 * time.Millisecond)
+	if resp, _ := get(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected half-open probe to succeed, got %d", resp.StatusCode)
+	}
+	if resp, _ := get(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected breaker to close again, got %d", resp.StatusCode)
+	}
+}
+
+func TestCircuitBreakerFailureRatio(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker("users", BreakerConfig{FailureRatio: 0.5, MinRequests: 4, ConsecutiveFailures: 100, Window: time.Minute, Cooldown: time.Second})
+	b.now = func() time.Time { return now }
+	yes, no := true, false
+	for _, outcome := range []*bool{&yes, &no, &yes, &no} {
+		gen, err := b.allow()
+		if err != nil {
+			t.Fatalf("unexpected rejection: %v", err)
+		}
+		b.record(gen, outcome)
+	}
+	if _, err := b.allow(); err == nil {
+		t.Fatalf("expected breaker to open at 50%% failures")
+	}
+	now = now.Add(2 * time.Second)
+	gen, err := b.allow()
+	if err != nil {
+		t.Fatalf("expected a half-open probe after cooldown: %v", err)
+	}
+	if _, err := b.allow(); err == nil {
+		t.Fatalf("expected only one concurrent half-open probe")
+	}
+	b.record(gen, &no)
+	if _, err := b.allow(); err == nil {
+		t.Fatalf("expected failed probe to reopen the breaker")
+	}
+}
+
+func TestRetryReplaysIdempotentRequests(t *testing.T) {
+	var hits atomic.Int32
+	var bodies []string
+	orders := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if hits.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	t.Setenv("ORDERS_URL", newUpstream(t, orders))
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+  orders:
+    targets: ["${ORDERS_URL}"]
+routes:
+  - name: orders
+    prefix: /v1/orders
+    upstream: orders
+    auth: false
+    retry:
+      attempts: 2
+      backoff: 1ms
+`))
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	gw := setupGatewayWithConfig(t, cfg)
+	send := func(method, idemKey string) int {
+		req, _ := http.NewRequest(method, gw.URL+"/v1/orders/", strings.NewReader(`{"items":"[]"}`))
+		if idemKey != "" {
+			req.Header.Set("Idempotency-Key", idemKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := send(http.MethodGet, ""); code != http.StatusOK || hits.Load() != 2 {
+		t.Fatalf("expected GET to be retried once, got %d after %d calls", code, hits.Load())
+	}
+	hits.Store(0)
+	if code := send(http.MethodPost, ""); code != http.StatusBadGateway || hits.Load() != 1 {
+		t.Fatalf("expected POST without Idempotency-Key to fail once, got %d after %d calls", code, hits.Load())
+	}
+	hits.Store(0)
+	bodies = nil
+	if code := send(http.MethodPost, "k1"); code != http.StatusOK || hits.Load() != 2 {
+		t.Fatalf("expected POST with Idempotency-Key to be retried, got %d after %d calls", code, hits.Load())
+	}
+	if len(bodies) != 2 || bodies[0] != bodies[1] || bodies[1] == "" {
+		t.Fatalf("expected retried POST to replay the body, got %q", bodies)
+	}
+}
+
+func TestRetryBudgetLimitsRetries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newRetryBudget(RetryBudgetConfig{Ratio: 0.5, MinPerSecond: 0.1})
+	b.now = func() time.Time { return now }
+	for i := 0; i < 4; i++ {
+		b.request()
+	}
+	granted := 0
+	for i := 0; i < 10; i++ {
+		if b.withdraw() {
+			granted++
+		}
+	}
+	// 0.5 * 4 requests + 0.1/s * 10s window
+	if granted != 3 {
+		t.Fatalf("expected 3 retries from the budget, got %d", granted)
+	}
+	now = now.Add(retryBudgetWindow)
+	if !b.withdraw() {
+		t.Fatalf("expected the budget to refill in a new window")
+	}
+}
+
+func TestUpstreamPoolBalancesAndHealthChecks(t *testing.T) {
+	var healthyB atomic.Bool
+	healthyB.Store(true)
+	instance := func(name string, healthy *atomic.Bool) string {
+		return newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				if healthy != nil && !healthy.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			io.WriteString(w, name)
+		}))
+	}
+	t.Setenv("USERS_URL", instance("a", nil)+", "+instance("b", &healthyB))
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+  users:
+    targets: ["${USERS_URL}"]
+    health_check:
+      path: /healthz
+      interval: 20ms
+      healthy_threshold: 1
+      unhealthy_threshold: 1
+  sticky:
+    targets: ["${USERS_URL}"]
+    balance: consistent_hash
+routes:
+  - name: users
+    prefix: /v1/users
+    upstream: users
+    auth: false
+  - name: sticky
+    prefix: /v1/sticky
+    upstream: sticky
+    auth: false
+`))
+	if err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+	gw := setupGatewayWithConfig(t, cfg)
+	served := func(path, token string) map[string]int {
+		seen := map[string]int{}
+		for i := 0; i < 6; i++ {
+			req, _ := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			seen[string(b)]++
+		}
+		return seen
+	}
+
+	if seen := served("/v1/users/", ""); seen["a"] != 3 || seen["b"] != 3 {
+		t.Fatalf("expected round robin over both instances, got %v", seen)
+	}
+	if seen := served("/v1/sticky/", tokenFor(t, "user-1", nil)); len(seen) != 1 {
+		t.Fatalf("expected consistent hash to pin a user to one instance, got %v", seen)
+	}
+
+	healthyB.Store(false)
+	if !eventually(func() bool { return served("/v1/users/", "")["b"] == 0 }) {
+		t.Fatalf("expected the failing instance to leave the rotation")
+	}
+	healthyB.Store(true)
+	if !eventually(func() bool { return served("/v1/users/", "")["b"] > 0 }) {
+		t.Fatalf("expected the recovered instance to rejoin the rotation")
+	}
+}
+
+func TestLeastConnPrefersIdleTarget(t *testing.T) {
+	a, _ := url.Parse("http://a")
+	b, _ := url.Parse("http://b")
+	p := newTargetPool("users", http.DefaultTransport)
+	p.update([]*url.URL{a, b}, balanceLeastConn, HealthCheckConfig{})
+	busy := p.pick("")
+	busy.active.Add(1)
+	for i := 0; i < 4; i++ {
+		if got := p.pick(""); got == busy {
+			t.Fatalf("expected least_conn to avoid the busy target %s", busy.url)
+		}
+	}
+}
+
+func TestGatewayForwardsSignedIdentity(t *testing.T) {
+	prev := internalAuthKey
+	internalAuthKey = []byte("internal-test-key")
+	t.Cleanup(func() { internalAuthKey = prev })
+	var got http.Header
+	users := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r.Header.Clone() })
+	gw := setupGatewayTest(t, newUpstream(t, users), newUpstream(t, http.NotFoundHandler()))
+	send := func(path, token string) {
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set("X-User-ID", "spoofed")
+		req.Header.Set("X-User-Roles", "admin")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	send("/v1/users/me", tokenFor(t, "user-1", []string{"user", "editor"}))
+	if got.Get("X-User-ID") != "user-1" || got.Get("X-User-Roles") != "user,editor" {
+		t.Fatalf("expected verified identity headers, got %v", got)
+	}
+	want := signIdentity(internalAuthKey, "user-1", "user,editor", got.Get("X-Identity-Timestamp"))
+	if got.Get("X-Identity-Signature") != want {
+		t.Fatalf("unexpected identity signature %q", got.Get("X-Identity-Signature"))
+	}
+
+	send("/v1/users/login", "")
+	if got.Get("X-User-ID") != "" || got.Get("X-User-Roles") != "" || got.Get("X-Identity-Signature") != "" {
+		t.Fatalf("client supplied identity headers reached a public route: %v", got)
+	}
+}
+
+func TestJWKSPicksUpRotatedKeys(t *testing.T) {
+	users := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	gw := setupGatewayTest(t, newUpstream(t, users), newUpstream(t, http.NotFoundHandler()))
+	get := func(token string) int {
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+"/v1/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	claims := jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if code := get(tokenFor(t, "user-1", nil)); code != http.StatusOK {
+		t.Fatalf("expected token from the published key to pass, got %d", code)
+	}
+	hs, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("dev-secret"))
+	if code := get(hs); code != http.StatusUnauthorized {
+		t.Fatalf("expected HS256 token to be rejected, got %d", code)
+	}
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	testKeysMu.Lock()
+	testKeys["rotated"] = priv
+	testKeysMu.Unlock()
+	t.Cleanup(func() {
+		testKeysMu.Lock()
+		delete(testKeys, "rotated")
+		testKeysMu.Unlock()
+	})
+	jwks.fetchMu.Lock()
+	jwks.attempted = time.Time{}
+	jwks.fetchMu.Unlock()
+	if code := get(signToken(t, "rotated", claims)); code != http.StatusOK {
+		t.Fatalf("expected an unknown kid to trigger a JWKS refetch, got %d", code)
+	}
+}
+
+func TestGatewayRejectsRevokedTokens(t *testing.T) {
+	var list atomic.Value
+	list.Store(`{"success":true,"data":[]}`)
+	users := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal/revocations" {
+			if r.Header.Get("X-Internal-Key") != "internal-test-key" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			io.WriteString(w, list.Load().(string))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	prevKey, prevList := internalAuthKey, revocations
+	internalAuthKey = []byte("internal-test-key")
+	revocations = newRevocationList(users+"/internal/revocations", "10s")
+	t.Cleanup(func() { internalAuthKey, revocations = prevKey, prevList })
+	orders := newUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }))
+	gw := setupGatewayTest(t, users, orders)
+	get := func(token string) int {
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+"/v1/orders/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	exp := time.Now().Add(time.Hour)
+	loggedOut := signToken(t, "test", jwt.MapClaims{"sub": "u1", "jti": "jti-1", "sid": "sid-1", "exp": exp.Unix()})
+	sameSession := signToken(t, "test", jwt.MapClaims{"sub": "u1", "jti": "jti-2", "sid": "sid-1", "exp": exp.Unix()})
+	other := signToken(t, "test", jwt.MapClaims{"sub": "u1", "jti": "jti-3", "sid": "sid-2", "exp": exp.Unix()})
+
+	if code := get(loggedOut); code != http.StatusOK {
+		t.Fatalf("expected token to pass before revocation, got %d", code)
+	}
+	list.Store(`{"success":true,"data":[{"kind":"jti","value":"jti-1","expires_at":"` + exp.Format(time.RFC3339) + `"},` +
+		`{"kind":"sid","value":"sid-1","expires_at":"` + exp.Format(time.RFC3339) + `"}]}`)
+	if err := revocations.sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if code := get(loggedOut); code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked jti to be rejected, got %d", code)
+	}
+	if code := get(sameSession); code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked session to be rejected, got %d", code)
+	}
+	if code := get(other); code != http.StatusOK {
+		t.Fatalf("expected other sessions to keep working, got %d", code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// gcraScript implements the generic cell rate algorithm on a single key that
+// stores the theoretical arrival time (TAT) in milliseconds. Time is taken
+// from the Redis server so replicas with skewed clocks still agree.
+//
+// KEYS[1] bucket key, ARGV[1] emission interval (ms), ARGV[2] burst.
+// Returns {allowed, remaining, retry_after_ms, reset_ms}.
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local tolerance = interval * burst
+
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat or tat < now then
+  tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - tolerance
+if allow_at > now then
+  return {0, 0, math.ceil(allow_at - now), math.ceil(tat - now)}
+end
+redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil(new_tat - now))
+local remaining = math.floor((tolerance - (new_tat - now)) / interval)
+return {1, remaining, 0, math.ceil(new_tat - now)}
+`)
+
+// redisLimiterStore keeps rate limit state in Redis so every gateway replica
+// draws from the same buckets.
+type redisLimiterStore struct {
+	client redis.Scripter
+	prefix string
+}
+
+func newRedisLimiterStore(client redis.Scripter) *redisLimiterStore {
+	return &redisLimiterStore{client: client, prefix: "gw:ratelimit:"}
+}
+
+func (s *redisLimiterStore) Take(ctx context.Context, key string, p RateLimitPolicy) (rateLimitResult, error) {
+	interval := 1000 / p.Rate
+	vals, err := gcraScript.Run(ctx, s.client, []string{s.prefix + p.Name + ":" + key}, interval, p.Burst).Int64Slice()
+	if err != nil {
+		return rateLimitResult{}, fmt.Errorf("redis rate limit: %w", err)
+	}
+	if len(vals) != 4 {
+		return rateLimitResult{}, fmt.Errorf("redis rate limit: unexpected reply %v", vals)
+	}
+	return rateLimitResult{
+		Allowed:    vals[0] == 1,
+		Limit:      p.Burst,
+		Remaining:  int(vals[1]),
+		RetryAfter: time.Duration(vals[2]) * time.Millisecond,
+		Reset:      time.Duration(vals[3]) * time.Millisecond,
+	}, nil
+}
+
+// newLimiterStore picks the rate limit backend named by RATE_LIMIT_BACKEND.
+func newLimiterStore(backend, redisURL string, idleTTL time.Duration) (LimiterStore, error) {
+	switch backend {
+	case "", "memory":
+		return newLimiterRegistry(idleTTL), nil
+	case "redis":
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_URL: %w", err)
+		}
+		return newRedisLimiterStore(redis.NewClient(opts)), nil
+	default:
+		return nil, fmt.Errorf("RATE_LIMIT_BACKEND: unknown backend %q", backend)
+	}
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	stdlog "log"
-	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -13,11 +12,8 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/time/rate"
 )
 
-var jwtSecret = []byte(getEnv("JWT_SECRET", "dev-secret"))
-
 func getEnv(k, def string) string {
 	v := os.Getenv(k)
 	if v == "" {
@@ -26,37 +22,46 @@ func getEnv(k, def string) string {
 	return v
 }
 
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 func main() {
 	r := gin.New()
-	r.Use(gin.Recovery())
+	// only trust X-Forwarded-For from explicitly configured proxies so
+	// per-IP rate limits cannot be dodged by spoofing the header
+	if err := r.SetTrustedProxies(splitList(getEnv("TRUSTED_PROXIES", ""))); err != nil {
+		stdlog.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	r.Use(recoverPanics())
 	r.Use(RequestID())
 	r.Use(RequestLogger())
 	r.Use(CORSMiddleware())
 
-	// rate limiter per IP
-	limiter := rate.NewLimiter(5, 20)
-
-	// proxy routes
-	usersURL := getEnv("USERS_URL", "http://service_users:8000")
-	ordersURL := getEnv("ORDERS_URL", "http://service_orders:8000")
-
-	v1 := r.Group("/v1")
-
-	v1.Any("/users/*path", func(c *gin.Context) {
-		if !limiter.Allow() {
-			c.AbortWithStatusJSON(429, gin.H{"success": false, "error": gin.H{"code": "rate_limited", "message": "rate limit"}})
-			return
-		}
-		proxyTo(c, usersURL)
-	})
-
-	v1.Any("/orders/*path", func(c *gin.Context) {
-		if !limiter.Allow() {
-			c.AbortWithStatusJSON(429, gin.H{"success": false, "error": gin.H{"code": "rate_limited", "message": "rate limit"}})
-			return
+	cfg, err := LoadConfig(getEnv("GATEWAY_CONFIG", ""))
+	if err != nil {
+		stdlog.Fatalf("invalid gateway config: %v", err)
+	}
+	gw, err := RegisterProxyRoutes(r, cfg)
+	if err != nil {
+		stdlog.Fatalf("invalid gateway config: %v", err)
+	}
+	if len(internalAuthKey) == 0 {
+		log.Warn().Msg("INTERNAL_AUTH_KEY is not set, identity headers are not forwarded and revocations are not synced")
+	} else {
+		go revocations.run(context.Background())
+	}
+	go func() {
+		if err := gw.WatchConfig(context.Background()); err != nil {
+			log.Error().Err(err).Msg("config_watch_stopped")
 		}
-		proxyTo(c, ordersURL)
-	})
+	}()
 
 	port := getEnv("PORT", "8000")
 	addr := fmt.Sprintf(":%s", port)
@@ -66,79 +71,31 @@ func main() {
 	}
 }
 
-func proxyTo(c *gin.Context, backend string) {
-	// simple reverse proxy: forward request to backend preserving method, headers and body
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(c.Request.Method, backend+c.Request.RequestURI, c.Request.Body)
-	if err != nil {
-		c.JSON(500, gin.H{"success": false})
-		return
-	}
-	// copy headers
-	for k, v := range c.Request.Header {
-		for _, vv := range v {
-			req.Header.Add(k, vv)
-		}
-	}
-	// propagate X-Request-ID
-	if req.Header.Get("X-Request-ID") == "" {
-		req.Header.Set("X-Request-ID", c.GetString("X-Request-ID"))
-	}
-	// log outgoing proxy
-	log.Info().Str("rid", c.GetString("X-Request-ID")).Str("to", backend+c.Request.RequestURI).Msg("proxy_request")
-	// JWT validation on protected paths (simple: only /users/register and /users/login public)
-	if isProtected(c.Request.RequestURI) {
-		auth := c.GetHeader("Authorization")
-		if auth == "" {
-			c.AbortWithStatusJSON(401, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "token required"}})
-			return
-		}
-		if !validateJWT(auth) {
-			c.AbortWithStatusJSON(401, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "invalid token"}})
-			return
-		}
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		c.JSON(502, gin.H{"success": false, "error": gin.H{"code": "bad_gateway", "message": err.Error()}})
-		return
-	}
-	defer resp.Body.Close()
-
-	// copy response
-	for k, v := range resp.Header {
-		for _, vv := range v {
-			c.Writer.Header().Add(k, vv)
-		}
+// parseJWT verifies the bearer token in authHeader against the users
+// service JWKS and returns its claims.
+func parseJWT(authHeader string) (jwt.MapClaims, bool) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, false
 	}
-	c.Status(resp.StatusCode)
-	io.Copy(c.Writer, resp.Body)
-}
-
-func isProtected(uri string) bool {
-	// naive: allow register/login without token
-	if strings.HasPrefix(uri, "/v1/users/register") || strings.HasPrefix(uri, "/v1/users/login") {
-		return false
+	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+	token, err := jwt.Parse(tokenStr, jwks.keyfunc)
+	if err != nil || !token.Valid {
+		return nil, false
 	}
-	return true
+	claims, ok := token.Claims.(jwt.MapClaims)
+	return claims, ok
 }
 
-func validateJWT(authHeader string) bool {
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return false
-	}
-	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-			return nil, jwt.ErrTokenUnverifiable
+func claimRoles(claims jwt.MapClaims) []string {
+	var roles []string
+	if rolesSlice, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range rolesSlice {
+			if s, ok := r.(string); ok {
+				roles = append(roles, s)
+			}
 		}
-		return jwtSecret, nil
-	})
-	if err != nil || !token.Valid {
-		return false
 	}
-	return true
+	return roles
 }
 
 func RequestID() gin.HandlerFunc {
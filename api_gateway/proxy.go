@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// upstreamTransport is shared by every proxy so keep-alive connections to the
+// services are pooled instead of being dialled per request.
+var upstreamTransport = newUpstreamTransport()
+
+func newUpstreamTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		// no ResponseHeaderTimeout: the per route timeout is the request
+		// context deadline and must be able to exceed any fixed limit here
+	}
+}
+
+// newRouteProxy builds a streaming reverse proxy for rt.
+// httputil.ReverseProxy strips hop-by-hop headers in both directions, handles
+// Upgrade, passes trailers through and streams bodies without buffering them.
+func newRouteProxy(rt *route) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path = rt.rewritePath(pr.In.URL.Path)
+			pr.Out.URL.RawPath = ""
+			// the target host is filled in per attempt by balancerTransport
+			pr.Out.Host = ""
+			// Rewrite already dropped any client supplied Forwarded/X-Forwarded-*
+			// headers, so these reflect what the gateway itself observed.
+			pr.SetXForwarded()
+			pr.Out.Header.Set("Forwarded", forwardedHeader(pr.In))
+		},
+		Transport:     rt.transport,
+		FlushInterval: 100 * time.Millisecond,
+		ErrorLog:      stdlog.New(log.Logger, "", 0),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var open *errCircuitOpen
+			if errors.As(err, &open) {
+				log.Warn().Str("rid", r.Header.Get("X-Request-ID")).Str("route", rt.Name).Str("upstream", open.upstream).Msg("circuit_open_reject")
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(open.retryAfter)))
+				writeGatewayError(w, http.StatusServiceUnavailable, "upstream_unavailable", "upstream "+open.upstream+" is unavailable")
+				return
+			}
+			// the raw error is logged but never returned, it leaks internal addresses
+			log.Error().Err(err).Str("rid", r.Header.Get("X-Request-ID")).Str("route", rt.Name).Msg("proxy_error")
+			if errors.Is(err, context.DeadlineExceeded) {
+				writeGatewayError(w, http.StatusGatewayTimeout, "gateway_timeout", "upstream timed out")
+				return
+			}
+			writeGatewayError(w, http.StatusBadGateway, "bad_gateway", "upstream request failed")
+		},
+	}
+}
+
+// proxyTo forwards the current request through rt after the gateway level
+// checks have passed.
+func proxyTo(c *gin.Context, rt *route) {
+	// propagate X-Request-ID
+	if c.Request.Header.Get("X-Request-ID") == "" {
+		c.Request.Header.Set("X-Request-ID", c.GetString("X-Request-ID"))
+	}
+	log.Info().Str("rid", c.GetString("X-Request-ID")).Str("route", rt.Name).Str("path", c.Request.RequestURI).Msg("proxy_request")
+	rt.proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// forwardedHeader renders the RFC 7239 Forwarded header for the hop between
+// the client and the gateway.
+func forwardedHeader(r *http.Request) string {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	parts := []string{}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if strings.Contains(ip, ":") {
+			ip = `"[` + ip + `]"`
+		}
+		parts = append(parts, "for="+ip)
+	}
+	if r.Host != "" {
+		parts = append(parts, fmt.Sprintf("host=%q", r.Host))
+	}
+	parts = append(parts, "proto="+proto)
+	return strings.Join(parts, ";")
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, code, message string) {
+	body, _ := json.Marshal(gin.H{"success": false, "error": gin.H{"code": code, "message": message}})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// recoverPanics replaces gin.Recovery so that http.ErrAbortHandler, raised by
+// the reverse proxy when an upstream body breaks mid-stream, still aborts the
+// client connection instead of finishing a truncated response as complete.
+func recoverPanics() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err any) {
+		if err == http.ErrAbortHandler {
+			panic(err)
+		}
+		log.Error().Str("rid", c.GetString("X-Request-ID")).
+			Interface("panic", err).
+			Str("stack", string(debug.Stack())).
+			Msg("panic_recovered")
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitPolicy is the token bucket budget applied to one group of routes.
+type RateLimitPolicy struct {
+	Name  string
+	Rate  float64 // tokens per second
+	Burst int
+}
+
+// rateLimitResult is the outcome of taking one token for a key.
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, only set when denied
+}
+
+// LimiterStore takes a token from the bucket identified by key under policy
+// p. Implementations must be safe for concurrent use; the in-memory registry
+// is per replica while the Redis store shares buckets between replicas.
+type LimiterStore interface {
+	Take(ctx context.Context, key string, p RateLimitPolicy) (rateLimitResult, error)
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterRegistry keeps one token bucket per policy and caller key. Entries
+// that have been idle for idleTTL and have refilled completely are evicted,
+// so dropping them never hands a caller a fresher budget than it would have.
+type limiterRegistry struct {
+	mu        sync.Mutex
+	entries   map[string]*limiterEntry
+	idleTTL   time.Duration
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLimiterRegistry(idleTTL time.Duration) *limiterRegistry {
+	return &limiterRegistry{
+		entries: map[string]*limiterEntry{},
+		idleTTL: idleTTL,
+		now:     time.Now,
+	}
+}
+
+func (r *limiterRegistry) Take(_ context.Context, key string, p RateLimitPolicy) (rateLimitResult, error) {
+	return r.take(key, p), nil
+}
+
+func (r *limiterRegistry) take(key string, p RateLimitPolicy) rateLimitResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.lastSweep) >= r.idleTTL {
+		r.sweep(now)
+		r.lastSweep = now
+	}
+
+	bucket := p.Name + "|" + key
+	e, ok := r.entries[bucket]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(p.Rate), p.Burst)}
+		r.entries[bucket] = e
+	} else if e.limiter.Limit() != rate.Limit(p.Rate) || e.limiter.Burst() != p.Burst {
+		// the policy changed under a config reload
+		e.limiter.SetLimitAt(now, rate.Limit(p.Rate))
+		e.limiter.SetBurstAt(now, p.Burst)
+	}
+	e.lastSeen = now
+
+	res := rateLimitResult{Limit: p.Burst}
+	rsv := e.limiter.ReserveN(now, 1)
+	if delay := rsv.DelayFrom(now); delay > 0 {
+		rsv.CancelAt(now)
+		res.RetryAfter = delay
+	} else {
+		res.Allowed = true
+	}
+	tokens := e.limiter.TokensAt(now)
+	res.Remaining = int(math.Max(0, math.Floor(tokens)))
+	if p.Rate > 0 {
+		res.Reset = time.Duration((float64(p.Burst) - tokens) / p.Rate * float64(time.Second))
+	}
+	return res
+}
+
+func (r *limiterRegistry) sweep(now time.Time) {
+	for k, e := range r.entries {
+		if now.Sub(e.lastSeen) >= r.idleTTL && e.limiter.TokensAt(now) >= float64(e.limiter.Burst()) {
+			delete(r.entries, k)
+		}
+	}
+}
+
+func (r *limiterRegistry) size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// rateLimit enforces p for the caller of c, who is identified by a configured
+// API key, then by the subject of a valid JWT, and finally by client IP. If
+// the store is unreachable the request is let through rather than failing
+// every call while the backend is down. It aborts the request and returns
+// false when the caller is over budget.
+func (g *Gateway) rateLimit(c *gin.Context, p RateLimitPolicy) bool {
+	res, err := g.limiter.Take(c.Request.Context(), rateLimitKey(c, g.apiKeys), p)
+	if err != nil {
+		log.Warn().Err(err).Str("rid", c.GetString("X-Request-ID")).Str("policy", p.Name).Msg("rate_limit_store_error")
+		return true
+	}
+	setRateLimitHeaders(c, res)
+	if !res.Allowed {
+		retry := ceilSeconds(res.RetryAfter)
+		c.Header("Retry-After", strconv.Itoa(retry))
+		c.AbortWithStatusJSON(429, gin.H{"success": false, "error": gin.H{"code": "rate_limited", "message": "rate limit", "retry_after": retry}})
+		return false
+	}
+	return true
+}
+
+func rateLimitKey(c *gin.Context, apiKeys map[string]bool) string {
+	if k := c.GetHeader("X-API-Key"); k != "" && apiKeys[k] {
+		sum := sha256.Sum256([]byte(k))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+	if claims, ok := parseJWT(c.GetHeader("Authorization")); ok {
+		if sub, _ := claims["sub"].(string); sub != "" {
+			return "user:" + sub
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func setRateLimitHeaders(c *gin.Context, res rateLimitResult) {
+	c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// parseRateLimitPolicy reads a "rate:burst" spec such as "5:20", falling back
+// to def when spec is empty.
+func parseRateLimitPolicy(name, spec string, def RateLimitPolicy) (RateLimitPolicy, error) {
+	def.Name = name
+	if spec == "" {
+		return def, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return def, fmt.Errorf("rate limit %q: expected rate:burst, got %q", name, spec)
+	}
+	rps, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rps <= 0 {
+		return def, fmt.Errorf("rate limit %q: invalid rate %q", name, parts[0])
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst <= 0 {
+		return def, fmt.Errorf("rate limit %q: invalid burst %q", name, parts[1])
+	}
+	return RateLimitPolicy{Name: name, Rate: rps, Burst: burst}, nil
+}
+
+func parseAPIKeys(s string) map[string]bool {
+	keys := map[string]bool{}
+	for _, k := range splitList(s) {
+		keys[k] = true
+	}
+	return keys
+}
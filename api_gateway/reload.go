@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// configVersion identifies the route table currently being served.
+type configVersion struct {
+	Version  int64     `json:"version"`
+	Hash     string    `json:"hash"`
+	Source   string    `json:"source"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// activate makes t the active table: its upstream state is brought up to
+// date, the table swapped in, and only then are upstreams it no longer uses
+// shut down, so requests still on the old table keep working. Callers must
+// hold reloadMu or be the only writer.
+func (g *Gateway) activate(t *routeTable) {
+	g.upstreams.apply(t.upstreams)
+	g.install(t)
+	g.upstreams.prune(t.upstreams)
+}
+
+// install swaps in t. Callers must hold reloadMu or be the only writer.
+func (g *Gateway) install(t *routeTable) {
+	g.versions++
+	t.version.Version = g.versions
+	g.table.Store(t)
+	v := t.version
+	log.Info().Int64("version", v.Version).Str("hash", shortHash(v.Hash)).Str("source", v.Source).Int("routes", len(t.routes)).Msg("config_active")
+}
+
+// Reload re-reads the config file, validates it and atomically swaps the
+// route table. On any error the current table stays active.
+func (g *Gateway) Reload(trigger string) error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	current := g.table.Load()
+	cfg, err := LoadConfig(g.configPath)
+	if err == nil && cfg.hash == current.version.Hash {
+		log.Info().Str("trigger", trigger).Int64("version", current.version.Version).Msg("config_unchanged")
+		g.lastError = nil
+		return nil
+	}
+	var table *routeTable
+	if err == nil {
+		table, err = buildRouteTable(cfg, upstreamTransport, g.upstreams)
+	}
+	if err != nil {
+		g.lastError = err
+		log.Error().Err(err).Str("trigger", trigger).Int64("active_version", current.version.Version).Msg("config_reload_rejected")
+		return err
+	}
+	g.lastError = nil
+	g.activate(table)
+	return nil
+}
+
+// WatchConfig reloads the config on SIGHUP and whenever the file changes
+// until ctx is done. The parent directory is watched so that editors and
+// Kubernetes ConfigMaps, which replace the file rather than writing to it,
+// are picked up as well; events for other files there are ignored.
+func (g *Gateway) WatchConfig(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	var watchErrs chan error
+	if g.configPath != "" {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if err := w.Add(filepath.Dir(g.configPath)); err != nil {
+			return err
+		}
+		events, watchErrs = w.Events, w.Errors
+	}
+
+	// editors emit several events per save; reload once they settle
+	const debounce = 200 * time.Millisecond
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	name := filepath.Base(g.configPath)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-hup:
+			g.Reload("sighup")
+		case ev := <-events:
+			// a ConfigMap update swaps the ..data symlink the file points through
+			if base := filepath.Base(ev.Name); base == name || base == "..data" {
+				timer.Reset(debounce)
+			}
+		case err := <-watchErrs:
+			log.Warn().Err(err).Msg("config_watch_error")
+		case <-timer.C:
+			g.Reload("file")
+		}
+	}
+}
+
+func (g *Gateway) handleConfigInfo(c *gin.Context) {
+	g.reloadMu.Lock()
+	lastErr := g.lastError
+	g.reloadMu.Unlock()
+
+	t := g.table.Load()
+	routes := make([]gin.H, 0, len(t.routes))
+	for _, rt := range t.routes {
+		routes = append(routes, gin.H{
+			"name":       rt.Name,
+			"prefix":     rt.Prefix,
+			"upstream":   rt.Upstream,
+			"auth":       rt.authRequired(),
+			"roles":      rt.Roles,
+			"timeout":    rt.Timeout.String(),
+			"rate_limit": rt.RateLimit,
+		})
+	}
+	data := gin.H{"active": t.version, "routes": routes}
+	if lastErr != nil {
+		data["last_reload_error"] = lastErr.Error()
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": data})
+}
+
+func (g *Gateway) handleConfigReload(c *gin.Context) {
+	if g.configPath == "" {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "not_reloadable", "message": "gateway runs on the builtin config, set GATEWAY_CONFIG"}})
+		return
+	}
+	if err := g.Reload("admin"); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"success": false, "error": gin.H{"code": "invalid_config", "message": err.Error()}, "data": gin.H{"active": g.table.Load().version}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"active": g.table.Load().version}})
+}
+
+func shortHash(h string) string {
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RetryConfig controls retries of one route. Attempts counts the first try,
+// so 0 or 1 disables retries.
+type RetryConfig struct {
+	Attempts     int           `yaml:"attempts"`
+	Backoff      time.Duration `yaml:"backoff"`        // base delay, doubled per retry (default 50ms)
+	MaxBackoff   time.Duration `yaml:"max_backoff"`    // cap on a single delay (default 1s)
+	MaxBodyBytes int64         `yaml:"max_body_bytes"` // larger bodies are streamed and never retried (default 1MiB)
+}
+
+func (rc RetryConfig) withDefaults() RetryConfig {
+	if rc.Attempts < 1 {
+		rc.Attempts = 1
+	}
+	if rc.Backoff == 0 {
+		rc.Backoff = 50 * time.Millisecond
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = time.Second
+	}
+	if rc.MaxBodyBytes == 0 {
+		rc.MaxBodyBytes = 1 << 20
+	}
+	return rc
+}
+
+func (rc RetryConfig) validate() error {
+	if rc.Attempts < 0 || rc.Backoff < 0 || rc.MaxBackoff < 0 || rc.MaxBodyBytes < 0 {
+		return errors.New("retry settings must not be negative")
+	}
+	return nil
+}
+
+// RetryBudgetConfig caps retries to an upstream at Ratio of its requests plus
+// MinPerSecond, so a struggling upstream does not get hit by a retry storm.
+type RetryBudgetConfig struct {
+	Ratio        float64 `yaml:"ratio"`          // default 0.2
+	MinPerSecond float64 `yaml:"min_per_second"` // default 5
+}
+
+func (bc RetryBudgetConfig) withDefaults() RetryBudgetConfig {
+	if bc.Ratio == 0 {
+		bc.Ratio = 0.2
+	}
+	if bc.MinPerSecond == 0 {
+		bc.MinPerSecond = 5
+	}
+	return bc
+}
+
+func (bc RetryBudgetConfig) validate() error {
+	if bc.Ratio < 0 || bc.MinPerSecond < 0 {
+		return errors.New("retry budget must not be negative")
+	}
+	return nil
+}
+
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudget counts requests and retries in fixed windows.
+type retryBudget struct {
+	now func() time.Time
+
+	mu          sync.Mutex
+	cfg         RetryBudgetConfig
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(cfg RetryBudgetConfig) *retryBudget {
+	return &retryBudget{cfg: cfg.withDefaults(), now: time.Now}
+}
+
+func (b *retryBudget) roll() {
+	if now := b.now(); now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.requests, b.retries = 0, 0
+	}
+}
+
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	b.roll()
+	b.requests++
+	b.mu.Unlock()
+}
+
+// withdraw reserves one retry if the budget allows it.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	allowed := b.cfg.Ratio*float64(b.requests) + b.cfg.MinPerSecond*retryBudgetWindow.Seconds()
+	if float64(b.retries+1) > allowed {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+func (b *retryBudget) setConfig(cfg RetryBudgetConfig) {
+	b.mu.Lock()
+	b.cfg = cfg.withDefaults()
+	b.mu.Unlock()
+}
+
+// retryTransport replays idempotent requests that failed with a connection
+// error or a 502/503/504, waiting an exponentially growing, fully jittered
+// delay between attempts.
+type retryTransport struct {
+	next   http.RoundTripper
+	cfg    RetryConfig
+	budget *retryBudget
+	route  string
+}
+
+// retryable reports whether req may be sent more than once. POST is only
+// replayed when the client marked it with an Idempotency-Key.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return req.Header.Get("Idempotency-Key") != ""
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.budget.request()
+	if t.cfg.Attempts <= 1 || !retryable(req) {
+		return t.next.RoundTrip(req)
+	}
+	replayable, err := t.bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			req.Body, _ = req.GetBody()
+		}
+		resp, err := t.next.RoundTrip(req)
+		reason := retryReason(resp, err)
+		if reason == "" || attempt >= t.cfg.Attempts || !t.budget.withdraw() {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		delay := t.backoff(attempt)
+		log.Warn().Str("rid", req.Header.Get("X-Request-ID")).Str("route", t.route).
+			Int("attempt", attempt).Str("reason", reason).Dur("backoff", delay).Msg("proxy_retry")
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// bufferBody reads up to MaxBodyBytes of the request body so it can be
+// replayed. A larger body is stitched back together and streamed once.
+func (t *retryTransport) bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, t.cfg.MaxBodyBytes+1))
+	if err != nil {
+		req.Body.Close()
+		return false, err
+	}
+	if int64(len(buf)) > t.cfg.MaxBodyBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false, nil
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(buf)), nil }
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.cfg.Backoff << (attempt - 1)
+	if d <= 0 || d > t.cfg.MaxBackoff {
+		d = t.cfg.MaxBackoff
+	}
+	return time.Duration(rand.Int64N(int64(d) + 1))
+}
+
+// retryReason returns why an attempt should be retried, or "" if it should
+// not. Open circuits and exhausted deadlines are final.
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		var open *errCircuitOpen
+		if errors.As(err, &open) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return ""
+		}
+		return "transport_error"
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return http.StatusText(resp.StatusCode)
+	}
+	return ""
+}
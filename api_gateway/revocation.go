@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// revocationList is the gateway's copy of the users service denylist. It is
+// replaced wholesale on every sync; a failed sync keeps the previous copy so
+// a users outage does not resurrect revoked tokens.
+type revocationList struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.RWMutex
+	entries map[string]time.Time // kind + ":" + value -> expiry
+}
+
+var revocations = newRevocationList(
+	getEnv("REVOCATIONS_URL", "http://service_users:8000/internal/revocations"),
+	getEnv("REVOCATION_SYNC_INTERVAL", "10s"),
+)
+
+func newRevocationList(url, interval string) *revocationList {
+	d, err := time.ParseDuration(interval)
+	if err != nil || d <= 0 {
+		d = 10 * time.Second
+	}
+	return &revocationList{url: url, interval: d, client: &http.Client{Timeout: 5 * time.Second}, entries: map[string]time.Time{}}
+}
+
+// revoked reports whether the token's jti or session sid is denylisted.
+func (l *revocationList) revoked(claims jwt.MapClaims) bool {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, kind := range []string{"jti", "sid"} {
+		v, _ := claims[kind].(string)
+		if v == "" {
+			continue
+		}
+		if exp, ok := l.entries[kind+":"+v]; ok && now.Before(exp) {
+			return true
+		}
+	}
+	return false
+}
+
+// run syncs the list every interval until ctx is done.
+func (l *revocationList) run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		if err := l.sync(ctx); err != nil {
+			log.Warn().Err(err).Str("url", l.url).Msg("revocation_sync_failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *revocationList) sync(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Internal-Key", string(internalAuthKey))
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocations: unexpected status %d", resp.StatusCode)
+	}
+	var body struct {
+		Data []struct {
+			Kind      string    `json:"kind"`
+			Value     string    `json:"value"`
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&body); err != nil {
+		return fmt.Errorf("revocations: %w", err)
+	}
+	entries := make(map[string]time.Time, len(body.Data))
+	for _, e := range body.Data {
+		entries[e.Kind+":"+e.Value] = e.ExpiresAt
+	}
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+	return nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -10,11 +12,27 @@ import (
 )
 
 type createOrderReq struct {
-	Items string  `json:"items" binding:"required"`
-	Total float64 `json:"total" binding:"required"`
+	Items json.RawMessage `json:"items" binding:"required"`
+	// Currency is an ISO 4217 code, ORDER_DEFAULT_CURRENCY when empty.
+	Currency string `json:"currency"`
+	// Total is optional; when sent it must match the computed total.
+	Total json.RawMessage `json:"total"`
 }
 
 func RegisterOrderHandlers(r *gin.Engine, db *gorm.DB) {
+	// liveness/readiness probe used by the gateway health checks
+	r.GET("/healthz", func(c *gin.Context) {
+		sqlDB, err := db.DB()
+		if err == nil {
+			err = sqlDB.PingContext(c.Request.Context())
+		}
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "error": gin.H{"code": "db_unavailable", "message": "database unreachable"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"status": "ok"}})
+	})
+
 	v1 := r.Group("/v1")
 	ord := v1.Group("/orders")
 
@@ -24,6 +42,33 @@ func RegisterOrderHandlers(r *gin.Engine, db *gorm.DB) {
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
 			return
 		}
+		currency := strings.ToUpper(req.Currency)
+		if currency == "" {
+			currency = defaultCurrency()
+		}
+		if _, ok := currencies[currency]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_currency", "message": "unsupported currency " + req.Currency}})
+			return
+		}
+		items, err := parseItems(req.Items, currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		// totals are always computed here; a client total is only a check
+		breakdown, total := pricingFromEnv(currency).price(items)
+		if len(req.Total) > 0 && string(req.Total) != "null" {
+			sent, err := parseAmount(req.Total, currency)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": "total " + err.Error()}})
+				return
+			}
+			if sent != total {
+				exp := currencyExponent(currency)
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"success": false, "error": gin.H{"code": "total_mismatch", "message": "total does not match the items", "details": gin.H{"expected": total.format(exp), "breakdown": breakdown.json(currency)}}})
+				return
+			}
+		}
 		uid := c.GetString("user_id")
 		parsed, _ := uuid.Parse(uid)
 		// check user exists
@@ -33,8 +78,24 @@ func RegisterOrderHandlers(r *gin.Engine, db *gorm.DB) {
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "user_not_found", "message": "user not found"}})
 			return
 		}
-		o := Order{UserID: parsed, Items: req.Items, Total: req.Total}
-		if err := db.Create(&o).Error; err != nil {
+		if getEnvOrders("REQUIRE_VERIFIED_EMAIL", "false") == "true" {
+			var verified int64
+			db.Table("users").Where("id = ? AND email_verified_at IS NOT NULL", parsed).Count(&verified)
+			if verified == 0 {
+				c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "email_not_verified", "message": "verify your email before placing orders"}})
+				return
+			}
+		}
+		// the order, its items and its first history entry are inserted in one
+		// transaction
+		o := Order{UserID: parsed, Status: statusCreated, Items: items, Currency: currency, Total: total, Breakdown: breakdown}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&o).Error; err != nil {
+				return err
+			}
+			return recordStatusChange(tx, c, o.ID, "", o.Status, "")
+		})
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot create order"}})
 			return
 		}
@@ -64,7 +125,7 @@ func RegisterOrderHandlers(r *gin.Engine, db *gorm.DB) {
 		var total int64
 		db.Model(&Order{}).Where("user_id = ?", parsed).Count(&total)
 		var orders []Order
-		db.Where("user_id = ?", parsed).Limit(size).Offset((page - 1) * size).Find(&orders)
+		withItems(db).Where("user_id = ?", parsed).Limit(size).Offset((page - 1) * size).Find(&orders)
 
 		totalPages := int((total + int64(size) - 1) / int64(size))
 		meta := gin.H{"total": total, "page": page, "size": size, "total_pages": totalPages}
@@ -79,7 +140,7 @@ func RegisterOrderHandlers(r *gin.Engine, db *gorm.DB) {
 			return
 		}
 		var o Order
-		if err := db.First(&o, "id = ?", id).Error; err != nil {
+		if err := withItems(db).First(&o, "id = ?", id).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
 				c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "order not found"}})
 				return
@@ -108,30 +169,94 @@ func RegisterOrderHandlers(r *gin.Engine, db *gorm.DB) {
 			return
 		}
 		var body struct {
-			Status string `json:"status"`
+			Status string `json:"status" binding:"required"`
+			Reason string `json:"reason" binding:"max=500"`
 		}
 		if err := c.ShouldBindJSON(&body); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
 			return
 		}
 		var o Order
-		if err := db.First(&o, "id = ?", id).Error; err != nil {
+		if err := withItems(db).First(&o, "id = ?", id).Error; err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "order not found"}})
 			return
 		}
 		// only owner or admin
 		uid := c.GetString("user_id")
-		if o.UserID.String() != uid {
+		rolesIface, _ := c.Get("roles")
+		roles, _ := rolesIface.([]string)
+		if o.UserID.String() != uid && !contains(roles, "admin") {
+			c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "forbidden", "message": "not allowed"}})
+			return
+		}
+		if !knownStatus(body.Status) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_status", "message": "status must be one of created, in_progress, done, cancelled"}})
+			return
+		}
+		actors := roles
+		if o.UserID.String() == uid {
+			actors = append([]string{roleOwner}, roles...)
+		}
+		allowed, ok := orderTransitions[o.Status][body.Status]
+		if !ok {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "invalid_transition", "message": "cannot move order from " + o.Status + " to " + body.Status, "details": gin.H{"status": o.Status, "allowed": nextStatuses(o.Status, actors)}}})
+			return
+		}
+		if !anyOf(allowed, actors) {
+			c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "forbidden", "message": "not allowed to move order to " + body.Status}})
+			return
+		}
+		// the status is matched again so a concurrent change is not overwritten
+		var changed bool
+		err = db.Transaction(func(tx *gorm.DB) error {
+			res := tx.Model(&Order{}).Where("id = ? AND status = ?", o.ID, o.Status).Update("status", body.Status)
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			changed = true
+			if err := recordStatusChange(tx, c, o.ID, o.Status, body.Status, body.Reason); err != nil {
+				return err
+			}
+			// answer with the row as updated, updated_at included
+			return withItems(tx).First(&o, "id = ?", o.ID).Error
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot update status"}})
+			return
+		}
+		if !changed {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "invalid_transition", "message": "order status changed meanwhile, reload and retry"}})
+			return
+		}
+		// domain event placeholder
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": o})
+	})
+
+	ord.GET("/:orderId/history", OrderAuthMiddleware(), func(c *gin.Context) {
+		id, err := uuid.Parse(c.Param("orderId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_id", "message": "invalid id"}})
+			return
+		}
+		var o Order
+		if err := db.First(&o, "id = ?", id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "order not found"}})
+			return
+		}
+		// only owner or admin
+		if o.UserID.String() != c.GetString("user_id") {
 			rolesIface, _ := c.Get("roles")
 			if roles, ok := rolesIface.([]string); !ok || !contains(roles, "admin") {
 				c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "forbidden", "message": "not allowed"}})
 				return
 			}
 		}
-		o.Status = body.Status
-		db.Save(&o)
-		// domain event placeholder
-		c.JSON(http.StatusOK, gin.H{"success": true, "data": o})
+		var history []OrderStatusHistory
+		if err := db.Where("order_id = ?", o.ID).Order("created_at, id").Find(&history).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "db error"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": history})
 	})
 
 	ord.DELETE("/:orderId", OrderAuthMiddleware(), func(c *gin.Context) {
@@ -154,7 +279,19 @@ func RegisterOrderHandlers(r *gin.Engine, db *gorm.DB) {
 				return
 			}
 		}
-		db.Delete(&o)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("order_id = ?", o.ID).Delete(&OrderItem{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("order_id = ?", o.ID).Delete(&OrderStatusHistory{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&o).Error
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot delete order"}})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"success": true})
 	})
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OrderStatusHistory records one status change of an order. From is empty
+// for the entry written when the order is created.
+type OrderStatusHistory struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	OrderID   uuid.UUID `gorm:"type:uuid;index;not null" json:"-"`
+	From      string    `gorm:"column:from_status" json:"from"`
+	To        string    `gorm:"column:to_status;not null" json:"to"`
+	ActorID   uuid.UUID `gorm:"type:uuid;index" json:"actor_id"`
+	Reason    string    `json:"reason,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (OrderStatusHistory) TableName() string { return "order_status_history" }
+
+func (h *OrderStatusHistory) BeforeCreate(tx *gorm.DB) (err error) {
+	if h.ID == uuid.Nil {
+		h.ID = uuid.New()
+	}
+	return nil
+}
+
+// recordStatusChange stores a move of orderID from one status to another,
+// attributed to the caller of c.
+func recordStatusChange(tx *gorm.DB, c *gin.Context, orderID uuid.UUID, from, to, reason string) error {
+	actor, _ := uuid.Parse(c.GetString("user_id"))
+	return tx.Create(&OrderStatusHistory{
+		OrderID:   orderID,
+		From:      from,
+		To:        to,
+		ActorID:   actor,
+		Reason:    reason,
+		RequestID: c.GetString("X-Request-ID"),
+	}).Error
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// identitySkew is how old (or how far in the future) a gateway identity may be.
+const identitySkew = 60 * time.Second
+
+var (
+	errMissingToken    = errors.New("missing token")
+	errInvalidToken    = errors.New("invalid token")
+	errInvalidClaims   = errors.New("invalid token claims")
+	errInvalidIdentity = errors.New("invalid gateway identity")
+)
+
+// authMode selects how callers are identified:
+//
+//	jwt     - the Authorization bearer token (default)
+//	gateway - X-User-ID/X-User-Roles signed by api_gateway with INTERNAL_AUTH_KEY
+//	both    - gateway headers when present, otherwise the bearer token
+func authMode() string {
+	return getEnvOrders("AUTH_MODE", "jwt")
+}
+
+// requestIdentity returns the authenticated caller of c.
+func requestIdentity(c *gin.Context) (string, []string, error) {
+	mode := authMode()
+	if mode == "gateway" || (mode == "both" && c.GetHeader("X-Identity-Signature") != "") {
+		return gatewayIdentity(c)
+	}
+	return bearerIdentity(c)
+}
+
+func bearerIdentity(c *gin.Context) (string, []string, error) {
+	auth := c.GetHeader("Authorization")
+	if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return "", nil, errMissingToken
+	}
+	tokenStr := strings.TrimPrefix(auth, "Bearer ")
+	token, err := jwt.Parse(tokenStr, jwks.keyfunc)
+	if err != nil || !token.Valid {
+		return "", nil, errInvalidToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", nil, errInvalidClaims
+	}
+	sub, _ := claims["sub"].(string)
+	var roles []string
+	if rolesSlice, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range rolesSlice {
+			if s, ok := r.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+	}
+	return sub, roles, nil
+}
+
+// gatewayIdentity verifies the identity headers set by api_gateway.
+func gatewayIdentity(c *gin.Context) (string, []string, error) {
+	key := getEnvOrders("INTERNAL_AUTH_KEY", "")
+	sub := c.GetHeader("X-User-ID")
+	roles := c.GetHeader("X-User-Roles")
+	ts := c.GetHeader("X-Identity-Timestamp")
+	sig := c.GetHeader("X-Identity-Signature")
+	if key == "" || sub == "" || sig == "" {
+		return "", nil, errInvalidIdentity
+	}
+	issued, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", nil, errInvalidIdentity
+	}
+	if age := time.Since(time.Unix(issued, 0)); age > identitySkew || age < -identitySkew {
+		return "", nil, errInvalidIdentity
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("v1\n" + sub + "\n" + roles + "\n" + ts))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", nil, errInvalidIdentity
+	}
+	var list []string
+	for _, r := range strings.Split(roles, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			list = append(list, r)
+		}
+	}
+	return sub, list, nil
+}
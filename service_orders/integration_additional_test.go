@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -17,12 +20,14 @@ import (
 )
 
 func setupOrdersTestEngine(t *testing.T) (*gin.Engine, *gorm.DB) {
-	os.Setenv("JWT_SECRET", "test-secret")
 	db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
 	if err != nil {
 		t.Fatalf("open db: %v", err)
 	}
-	if err := db.AutoMigrate(&User{}, &Order{}); err != nil {
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := migrateOrders(db); err != nil {
 		t.Fatalf("migrate: %v", err)
 	}
 	r := gin.New()
@@ -39,8 +44,7 @@ func createTokenForUser(id uuid.UUID) (string, error) {
 		"roles": []string{},
 		"exp":   time.Now().Add(time.Hour).Unix(),
 	}
-	tokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return tokenObj.SignedString(jwtSecretOrders)
+	return signTestToken(claims)
 }
 
 func TestOrderStatusChangeAndDelete(t *testing.T) {
@@ -58,7 +62,7 @@ func TestOrderStatusChangeAndDelete(t *testing.T) {
 	}
 
 	// create order
-	order := map[string]interface{}{"items": "[]", "total": 5.0}
+	order := map[string]interface{}{"items": testItems, "total": 1.0}
 	b, _ := json.Marshal(order)
 	req := httptest.NewRequest(http.MethodPost, "/v1/orders/", bytes.NewReader(b))
 	req.Header.Set("Content-Type", "application/json")
@@ -143,7 +147,7 @@ func TestForbiddenModifyOtherOrder(t *testing.T) {
 	otherToken, _ := createTokenForUser(otherID)
 
 	// owner creates order
-	order := map[string]interface{}{"items": "[]", "total": 7.0}
+	order := map[string]interface{}{"items": testItems, "total": 1.0}
 	b, _ := json.Marshal(order)
 	req := httptest.NewRequest(http.MethodPost, "/v1/orders/", bytes.NewReader(b))
 	req.Header.Set("Content-Type", "application/json")
@@ -161,7 +165,7 @@ func TestForbiddenModifyOtherOrder(t *testing.T) {
 	id := data["id"].(string)
 
 	// other tries to change status
-	statusBody := map[string]string{"status": "shipped"}
+	statusBody := map[string]string{"status": "cancelled"}
 	sb, _ := json.Marshal(statusBody)
 	req = httptest.NewRequest(http.MethodPut, "/v1/orders/"+id+"/status", bytes.NewReader(sb))
 	req.Header.Set("Content-Type", "application/json")
@@ -195,7 +199,7 @@ func TestOrdersPagination(t *testing.T) {
 
 	// create 25 orders
 	for i := 0; i < 25; i++ {
-		order := map[string]interface{}{"items": "[]", "total": 1.0}
+		order := map[string]interface{}{"items": testItems, "total": 1.0}
 		b, _ := json.Marshal(order)
 		req := httptest.NewRequest(http.MethodPost, "/v1/orders/", bytes.NewReader(b))
 		req.Header.Set("Content-Type", "application/json")
@@ -237,3 +241,169 @@ func TestOrdersPagination(t *testing.T) {
 		t.Fatalf("expected 10 items on page, got %d", len(data))
 	}
 }
+
+func gatewayHeaders(req *http.Request, key, sub, roles string, issued time.Time) {
+	ts := strconv.FormatInt(issued.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("v1\n" + sub + "\n" + roles + "\n" + ts))
+	req.Header.Set("X-User-ID", sub)
+	req.Header.Set("X-User-Roles", roles)
+	req.Header.Set("X-Identity-Timestamp", ts)
+	req.Header.Set("X-Identity-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestGatewayIdentityMode(t *testing.T) {
+	r, _ := setupOrdersTestEngine(t)
+	t.Setenv("AUTH_MODE", "gateway")
+	t.Setenv("INTERNAL_AUTH_KEY", "internal-test-key")
+	uid := uuid.New().String()
+	list := func(setup func(req *http.Request)) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/orders/", nil)
+		setup(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := list(func(req *http.Request) { gatewayHeaders(req, "internal-test-key", uid, "user", time.Now()) }); code != http.StatusOK {
+		t.Fatalf("expected signed identity to be accepted, got %d", code)
+	}
+	if code := list(func(req *http.Request) { gatewayHeaders(req, "wrong-key", uid, "user", time.Now()) }); code != http.StatusUnauthorized {
+		t.Fatalf("expected forged identity to be rejected, got %d", code)
+	}
+	if code := list(func(req *http.Request) {
+		gatewayHeaders(req, "internal-test-key", uid, "user", time.Now().Add(-5*time.Minute))
+	}); code != http.StatusUnauthorized {
+		t.Fatalf("expected stale identity to be rejected, got %d", code)
+	}
+	token, _ := createTokenForUser(uuid.MustParse(uid))
+	if code := list(func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }); code != http.StatusUnauthorized {
+		t.Fatalf("expected bearer token to be ignored in gateway mode, got %d", code)
+	}
+
+	t.Setenv("AUTH_MODE", "both")
+	if code := list(func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }); code != http.StatusOK {
+		t.Fatalf("expected bearer token to be accepted in both mode, got %d", code)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	r, db := setupOrdersTestEngine(t)
+	t.Setenv("REQUIRE_VERIFIED_EMAIL", "true")
+	uid := uuid.New()
+	if err := db.Create(&User{ID: uid, Email: "unverified@example.com", Name: "U"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	token, _ := createTokenForUser(uid)
+	body := map[string]interface{}{"items": testItems, "total": 1}
+
+	w, resp := doJSON(r, http.MethodPost, "/v1/orders/", token, body)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for unverified user, got %d %s", w.Code, w.Body.String())
+	}
+	if code := resp["error"].(map[string]interface{})["code"]; code != "email_not_verified" {
+		t.Fatalf("unexpected error code %v", code)
+	}
+
+	db.Model(&User{}).Where("id = ?", uid).Update("email_verified_at", time.Now())
+	if w, _ := doJSON(r, http.MethodPost, "/v1/orders/", token, body); w.Code != http.StatusCreated {
+		t.Fatalf("expected verified user to create order, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOrderStatusTransitions(t *testing.T) {
+	r, db := setupOrdersTestEngine(t)
+	uid := uuid.New()
+	if err := db.Create(&User{ID: uid, Email: "transitions@example.com", Name: "Owner"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	token, _ := createTokenForUser(uid)
+	adminToken, _ := signTestToken(jwt.MapClaims{"sub": uuid.New().String(), "roles": []string{"admin"}, "exp": time.Now().Add(time.Hour).Unix()})
+
+	errCode := func(resp map[string]interface{}) interface{} {
+		e, _ := resp["error"].(map[string]interface{})
+		return e["code"]
+	}
+	_, created := doJSON(r, http.MethodPost, "/v1/orders/", token, map[string]interface{}{"items": testItems})
+	status := "/v1/orders/" + created["data"].(map[string]interface{})["id"].(string) + "/status"
+
+	if w, resp := doJSON(r, http.MethodPut, status, token, map[string]string{"status": "shipped"}); w.Code != http.StatusBadRequest || errCode(resp) != "invalid_status" {
+		t.Fatalf("expected invalid_status, got %d %v", w.Code, resp)
+	}
+	// skipping in_progress is refused and the owner is told what they may do
+	w, resp := doJSON(r, http.MethodPut, status, token, map[string]string{"status": "done"})
+	if w.Code != http.StatusConflict || errCode(resp) != "invalid_transition" {
+		t.Fatalf("expected invalid_transition, got %d %v", w.Code, resp)
+	}
+	if allowed := resp["error"].(map[string]interface{})["details"].(map[string]interface{})["allowed"].([]interface{}); len(allowed) != 1 || allowed[0] != "cancelled" {
+		t.Fatalf("unexpected allowed states %v", allowed)
+	}
+	// only an admin starts work on an order
+	if w, resp := doJSON(r, http.MethodPut, status, token, map[string]string{"status": "in_progress"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected owner to be refused in_progress, got %d %v", w.Code, resp)
+	}
+	w, started := doJSON(r, http.MethodPut, status, adminToken, map[string]string{"status": "in_progress"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin in_progress: %d %v", w.Code, started)
+	}
+	// the response is the updated row
+	if data := started["data"].(map[string]interface{}); data["status"] != "in_progress" || data["updated_at"] == created["data"].(map[string]interface{})["updated_at"] {
+		t.Fatalf("expected the updated order in the response, got %v", data)
+	}
+	// once started the owner can no longer cancel
+	if w, resp := doJSON(r, http.MethodPut, status, token, map[string]string{"status": "cancelled"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected owner cancel of started order to be refused, got %d %v", w.Code, resp)
+	}
+	if w, resp := doJSON(r, http.MethodPut, status, adminToken, map[string]string{"status": "done"}); w.Code != http.StatusOK {
+		t.Fatalf("admin done: %d %v", w.Code, resp)
+	}
+	// done is final
+	w, resp = doJSON(r, http.MethodPut, status, adminToken, map[string]string{"status": "created"})
+	if w.Code != http.StatusConflict || len(resp["error"].(map[string]interface{})["details"].(map[string]interface{})["allowed"].([]interface{})) != 0 {
+		t.Fatalf("expected done to be final, got %d %v", w.Code, resp)
+	}
+}
+
+func TestOrderStatusHistory(t *testing.T) {
+	r, db := setupOrdersTestEngine(t)
+	uid, otherID, adminID := uuid.New(), uuid.New(), uuid.New()
+	db.Create(&User{ID: uid, Email: "history@example.com", Name: "Owner"})
+	db.Create(&User{ID: otherID, Email: "history-other@example.com", Name: "Other"})
+	token, _ := createTokenForUser(uid)
+	otherToken, _ := createTokenForUser(otherID)
+	adminToken, _ := signTestToken(jwt.MapClaims{"sub": adminID.String(), "roles": []string{"admin"}, "exp": time.Now().Add(time.Hour).Unix()})
+
+	w, resp := doJSON(r, http.MethodPost, "/v1/orders/", token, map[string]interface{}{"items": testItems})
+	createRID := w.Header().Get("X-Request-ID")
+	base := "/v1/orders/" + resp["data"].(map[string]interface{})["id"].(string)
+	w, resp = doJSON(r, http.MethodPut, base+"/status", adminToken, map[string]string{"status": "in_progress", "reason": "picked"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status change: %d %v", w.Code, resp)
+	}
+	changeRID := w.Header().Get("X-Request-ID")
+	// a refused transition leaves no trace
+	doJSON(r, http.MethodPut, base+"/status", token, map[string]string{"status": "cancelled"})
+
+	w, resp = doJSON(r, http.MethodGet, base+"/history", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("history: %d %v", w.Code, resp)
+	}
+	entries := resp["data"].([]interface{})
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 history entries, got %v", entries)
+	}
+	first, second := entries[0].(map[string]interface{}), entries[1].(map[string]interface{})
+	if first["from"] != "" || first["to"] != "created" || first["actor_id"] != uid.String() || createRID == "" || first["request_id"] != createRID {
+		t.Fatalf("unexpected creation entry %v", first)
+	}
+	if second["from"] != "created" || second["to"] != "in_progress" || second["actor_id"] != adminID.String() || second["reason"] != "picked" || second["request_id"] != changeRID {
+		t.Fatalf("unexpected transition entry %v", second)
+	}
+
+	if w, _ := doJSON(r, http.MethodGet, base+"/history", adminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected admin to read history, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodGet, base+"/history", otherToken, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected other user to be refused history, got %d", w.Code)
+	}
+}
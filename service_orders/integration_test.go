@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -18,9 +21,10 @@ import (
 
 // Local minimal User model used only for tests in this package.
 type User struct {
-	ID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	Email string    `gorm:"uniqueIndex;not null" json:"email"`
-	Name  string    `json:"name"`
+	ID              uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	Email           string     `gorm:"uniqueIndex;not null" json:"email"`
+	Name            string     `json:"name"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 }
 
 func (u *User) BeforeCreate(tx *gorm.DB) (err error) {
@@ -30,13 +34,37 @@ func (u *User) BeforeCreate(tx *gorm.DB) (err error) {
 	return nil
 }
 
+// testKey stands in for the users service signing key; TestMain serves its
+// public half as the JWKS.
+var testKey ed25519.PrivateKey
+
+func TestMain(m *testing.M) {
+	_, testKey, _ = ed25519.GenerateKey(rand.Reader)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x := base64.RawURLEncoding.EncodeToString(testKey.Public().(ed25519.PublicKey))
+		json.NewEncoder(w).Encode(gin.H{"keys": []gin.H{{"kid": "test", "kty": "OKP", "crv": "Ed25519", "alg": "EdDSA", "x": x}}})
+	}))
+	jwks = newJWKSCache(srv.URL, "5m")
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
+}
+
+func signTestToken(claims jwt.MapClaims) (string, error) {
+	tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	tok.Header["kid"] = "test"
+	return tok.SignedString(testKey)
+}
+
 func setupOrdersTest(t *testing.T) (*gin.Engine, *gorm.DB, string) {
-	os.Setenv("JWT_SECRET", "test-secret")
 	db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
 	if err != nil {
 		t.Fatalf("open db: %v", err)
 	}
-	if err := db.AutoMigrate(&User{}, &Order{}); err != nil {
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := migrateOrders(db); err != nil {
 		t.Fatalf("migrate: %v", err)
 	}
 	r := gin.New()
@@ -56,19 +84,40 @@ func setupOrdersTest(t *testing.T) (*gin.Engine, *gorm.DB, string) {
 		"roles": []string{},
 		"exp":   time.Now().Add(time.Hour).Unix(),
 	}
-	tokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenStr, err := tokenObj.SignedString(jwtSecretOrders)
+	tokenStr, err := signTestToken(claims)
 	if err != nil {
 		t.Fatalf("sign token: %v", err)
 	}
 	return r, db, tokenStr
 }
 
+// doJSON sends body as JSON (nil for none) with an optional bearer token and
+// returns the recorder together with the decoded response.
+func doJSON(r *gin.Engine, method, path, token string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	var rd *bytes.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	} else {
+		rd = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, rd)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
 func TestCreateAndGetOrder(t *testing.T) {
 	r, _, token := setupOrdersTest(t)
 
-	// create with items as JSON string because createOrderReq expects Items string
-	order := map[string]interface{}{"items": "[]", "total": 10.5}
+	// items as a JSON-encoded string, the way older clients send them
+	order := map[string]interface{}{"items": `[{"sku":"SKU-1","name":"Widget","quantity":2,"unit_price":5.25}]`, "total": 10.5}
 	b, _ := json.Marshal(order)
 	req := httptest.NewRequest(http.MethodPost, "/v1/orders/", bytes.NewReader(b))
 	req.Header.Set("Content-Type", "application/json")
@@ -93,4 +142,226 @@ func TestCreateAndGetOrder(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Fatalf("get order failed: %d %s", w.Code, w.Body.String())
 	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	items := resp["data"].(map[string]interface{})["items"].([]interface{})
+	if len(items) != 1 || items[0].(map[string]interface{})["sku"] != "SKU-1" || items[0].(map[string]interface{})["quantity"].(float64) != 2 {
+		t.Fatalf("unexpected items %v", items)
+	}
+}
+
+func TestServerComputedTotals(t *testing.T) {
+	t.Setenv("ORDER_TAX_RATE", "0.2")
+	t.Setenv("ORDER_DISCOUNT_RATE", "0.1")
+	t.Setenv("ORDER_DISCOUNT_MIN_SUBTOTAL", "50")
+	r, db := setupOrdersTestEngine(t)
+	uid := uuid.New()
+	if err := db.Create(&User{ID: uid, Email: "totals@example.com", Name: "Totals"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	token, _ := createTokenForUser(uid)
+	create := func(body map[string]interface{}) (int, map[string]interface{}) {
+		w, resp := doJSON(r, http.MethodPost, "/v1/orders/", token, body)
+		return w.Code, resp
+	}
+	items := []map[string]interface{}{
+		{"sku": "A", "quantity": 3, "unit_price": 19.99},
+		{"sku": "B", "quantity": 1, "unit_price": 0.05},
+	}
+
+	// a client trying to pay less is refused
+	code, resp := create(map[string]interface{}{"items": items, "total": 0.01})
+	if code != http.StatusUnprocessableEntity || resp["error"].(map[string]interface{})["code"] != "total_mismatch" {
+		t.Fatalf("expected total_mismatch, got %d %v", code, resp)
+	}
+
+	// subtotal 60.02, discount 6.00, tax 20% of 54.02 = 10.80, total 64.82
+	code, resp = create(map[string]interface{}{"items": items})
+	if code != http.StatusCreated {
+		t.Fatalf("create without total: %d %v", code, resp)
+	}
+	data := resp["data"].(map[string]interface{})
+	bd := data["breakdown"].(map[string]interface{})
+	if bd["subtotal"] != "60.02" || bd["discount"] != "6.00" || bd["tax"] != "10.80" || bd["tax_rate"] != 0.2 || data["total"] != "64.82" {
+		t.Fatalf("unexpected breakdown %v total %v", bd, data["total"])
+	}
+	if line := data["items"].([]interface{})[0].(map[string]interface{})["line_total"]; line != "59.97" {
+		t.Fatalf("unexpected line_total %v", line)
+	}
+	for _, total := range []interface{}{64.82, "64.82", "64.820"} {
+		if code, resp = create(map[string]interface{}{"items": items, "total": total}); code != http.StatusCreated {
+			t.Fatalf("matching total %v refused: %d %v", total, code, resp)
+		}
+	}
+
+	// below the threshold there is no discount
+	code, resp = create(map[string]interface{}{"items": items[1:]})
+	if bd := resp["data"].(map[string]interface{})["breakdown"].(map[string]interface{}); code != http.StatusCreated || bd["discount"] != "0.00" || bd["tax"] != "0.01" {
+		t.Fatalf("unexpected small order breakdown: %d %v", code, bd)
+	}
+}
+
+func TestOrderCurrency(t *testing.T) {
+	r, db := setupOrdersTestEngine(t)
+	uid := uuid.New()
+	if err := db.Create(&User{ID: uid, Email: "currency@example.com", Name: "Currency"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	token, _ := createTokenForUser(uid)
+	create := func(body map[string]interface{}) (int, map[string]interface{}) {
+		w, resp := doJSON(r, http.MethodPost, "/v1/orders/", token, body)
+		return w.Code, resp
+	}
+
+	code, resp := create(map[string]interface{}{"currency": "jpy", "items": []map[string]interface{}{{"sku": "A", "quantity": 2, "unit_price": "1500", "currency": "JPY"}}})
+	if code != http.StatusCreated {
+		t.Fatalf("create JPY order: %d %v", code, resp)
+	}
+	data := resp["data"].(map[string]interface{})
+	item := data["items"].([]interface{})[0].(map[string]interface{})
+	if data["currency"] != "JPY" || data["total"] != "3000" || item["unit_price"] != "1500" || item["currency"] != "JPY" {
+		t.Fatalf("unexpected JPY order %v", data)
+	}
+
+	for name, body := range map[string]map[string]interface{}{
+		"mixed currencies": {"currency": "EUR", "items": []map[string]interface{}{{"sku": "A", "quantity": 1, "unit_price": "1", "currency": "USD"}}},
+		"too many places":  {"items": []map[string]interface{}{{"sku": "A", "quantity": 1, "unit_price": "5.255"}}},
+		"exponent":         {"items": []map[string]interface{}{{"sku": "A", "quantity": 1, "unit_price": "1e2"}}},
+		"unknown currency": {"currency": "XYZ", "items": testItems},
+	} {
+		if code, resp := create(body); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d %v", name, code, resp)
+		}
+	}
+}
+
+func TestMigrateFloatAmounts(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:float_amounts?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	// the tables as they were when amounts were floats
+	db.Exec(`CREATE TABLE orders (id text PRIMARY KEY, user_id text NOT NULL, status text DEFAULT 'created', total real, subtotal real NOT NULL DEFAULT 0, discount real NOT NULL DEFAULT 0, tax real NOT NULL DEFAULT 0, tax_rate real NOT NULL DEFAULT 0, created_at datetime, updated_at datetime)`)
+	db.Exec(`CREATE TABLE order_items (id text PRIMARY KEY, order_id text NOT NULL, position integer NOT NULL DEFAULT 0, sku text, product_id text, name text, quantity integer NOT NULL, unit_price real NOT NULL, line_total real NOT NULL DEFAULT 0)`)
+	id := uuid.New()
+	db.Exec(`INSERT INTO orders (id, user_id, total, subtotal, discount, tax, tax_rate) VALUES (?, ?, 0.3, 0.3, 0.1, 0.1, 0.5)`, id, uuid.New())
+	db.Exec(`INSERT INTO order_items (id, order_id, sku, quantity, unit_price, line_total) VALUES (?, ?, 'A', 3, 0.1, 0.3)`, uuid.New(), id)
+
+	if err := migrateOrders(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	var o Order
+	withItems(db).First(&o, "id = ?", id)
+	if o.Total != 30 || o.Breakdown.Subtotal != 30 || o.Breakdown.Discount != 10 || o.Breakdown.Tax != 10 || o.Breakdown.TaxRate != 500000 || o.Currency != "USD" {
+		t.Fatalf("unexpected migrated order %+v", o)
+	}
+	if len(o.Items) != 1 || o.Items[0].UnitPrice != 10 || o.Items[0].LineTotal != 30 || o.Items[0].Currency != "USD" {
+		t.Fatalf("unexpected migrated items %+v", o.Items)
+	}
+	if db.Migrator().HasColumn("orders", "total") || db.Migrator().HasColumn("orders", "tax_rate") || db.Migrator().HasColumn("order_items", "unit_price") {
+		t.Fatalf("float columns were not dropped")
+	}
+	// new orders can be written to the migrated tables
+	if err := db.Create(&Order{UserID: uuid.New(), Currency: "USD", Items: []OrderItem{{SKU: "B", Quantity: 1, Currency: "USD", UnitPrice: 5}}}).Error; err != nil {
+		t.Fatalf("create after migrate: %v", err)
+	}
+}
+
+// testItems is a minimal valid items payload.
+var testItems = []map[string]interface{}{{"sku": "SKU-1", "name": "Widget", "quantity": 1, "unit_price": 1.0}}
+
+func TestOrderItemsValidation(t *testing.T) {
+	r, db := setupOrdersTestEngine(t)
+	uid := uuid.New()
+	if err := db.Create(&User{ID: uid, Email: "items@example.com", Name: "Items"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	token, _ := createTokenForUser(uid)
+	create := func(items interface{}) int {
+		w, _ := doJSON(r, http.MethodPost, "/v1/orders/", token, map[string]interface{}{"items": items})
+		return w.Code
+	}
+	for _, items := range []interface{}{
+		"[]",
+		[]interface{}{},
+		"not json",
+		map[string]interface{}{"sku": "A"},
+		[]map[string]interface{}{{"name": "no id", "quantity": 1, "unit_price": 1}},
+		[]map[string]interface{}{{"sku": "A", "quantity": 0, "unit_price": 1}},
+		[]map[string]interface{}{{"sku": "A", "quantity": 1}},
+		[]map[string]interface{}{{"sku": "A", "quantity": 1, "unit_price": -1}},
+		[]map[string]interface{}{{"sku": "A", "quantity": 1, "unit_price": 1, "colour": "red"}},
+	} {
+		if code := create(items); code != http.StatusBadRequest {
+			t.Fatalf("expected items %v to be refused, got %d", items, code)
+		}
+	}
+	if code := create([]map[string]interface{}{{"product_id": "p-1", "quantity": 3, "unit_price": 0}}); code != http.StatusCreated {
+		t.Fatalf("expected product_id item to be accepted, got %d", code)
+	}
+	// a single line item object is read as a one item list
+	for _, items := range []interface{}{
+		map[string]interface{}{"sku": "A", "quantity": 1, "unit_price": "2.50"},
+		`{"sku":"A","quantity":1,"unit_price":"2.50"}`,
+	} {
+		if code := create(items); code != http.StatusCreated {
+			t.Fatalf("expected single item %v to be accepted, got %d", items, code)
+		}
+	}
+}
+
+func TestMigrateLegacyItems(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:legacy_items?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	// the orders table as it was when items were a JSON column
+	db.Exec(`CREATE TABLE orders (id text PRIMARY KEY, user_id text NOT NULL, items text, status text DEFAULT 'created', total real, created_at datetime, updated_at datetime)`)
+	good, bad, badPrice, empty := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	db.Exec(`INSERT INTO orders (id, user_id, items, total) VALUES (?, ?, ?, 3), (?, ?, ?, 1), (?, ?, ?, 1), (?, ?, ?, 0)`,
+		good, uuid.New(), `[{"sku":"A","name":"Apple","quantity":3,"unit_price":1}]`,
+		bad, uuid.New(), `{"free":"form"}`,
+		badPrice, uuid.New(), `[{"sku":"B","quantity":1,"unit_price":-1}]`,
+		empty, uuid.New(), `[]`)
+
+	if err := migrateOrders(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	var o Order
+	withItems(db).First(&o, "id = ?", good)
+	if len(o.Items) != 1 || o.Items[0].SKU != "A" || o.Items[0].Quantity != 3 || o.Items[0].LineTotal != 300 {
+		t.Fatalf("legacy items not migrated: %+v", o.Items)
+	}
+	if o.Breakdown.Subtotal != 300 || o.Total != 300 || o.Currency != "USD" {
+		t.Fatalf("legacy total not kept as subtotal: %+v total %v", o.Breakdown, o.Total)
+	}
+	// unreadable items are kept and returned as they were stored
+	for id, raw := range map[uuid.UUID]string{bad: `{"free":"form"}`, badPrice: `[{"sku":"B","quantity":1,"unit_price":-1}]`} {
+		var o Order
+		withItems(db).First(&o, "id = ?", id)
+		b, _ := json.Marshal(o)
+		var out map[string]interface{}
+		json.Unmarshal(b, &out)
+		if out["legacy_items"] != raw || len(out["items"].([]interface{})) != 0 {
+			t.Fatalf("expected unreadable items to be returned as legacy_items, got %s", b)
+		}
+	}
+	var left int64
+	db.Table("orders").Where("items IS NOT NULL").Count(&left)
+	if left != 0 {
+		t.Fatalf("expected every legacy items value to be moved, %d left", left)
+	}
+	if b, _ := json.Marshal(o); bytes.Contains(b, []byte("legacy_items")) {
+		t.Fatalf("expected converted orders to have no legacy_items, got %s", b)
+	}
+	// running again changes nothing
+	if err := migrateOrders(db); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	var n int64
+	db.Model(&OrderItem{}).Count(&n)
+	if n != 1 {
+		t.Fatalf("expected 1 item after a second run, got %d", n)
+	}
 }
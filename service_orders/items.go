@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	maxOrderItems   = 100
+	maxItemQuantity = 10000
+	// maxUnitPrice keeps every order total far from int64 overflow
+	maxUnitPrice Money = 1e11
+)
+
+// itemInput is one line item as clients send it.
+type itemInput struct {
+	SKU       string          `json:"sku"`
+	ProductID string          `json:"product_id"`
+	Name      string          `json:"name"`
+	Quantity  int             `json:"quantity"`
+	Currency  string          `json:"currency"`
+	UnitPrice json.RawMessage `json:"unit_price"`
+}
+
+// parseItems reads the items of a create request: an array of line items or,
+// for older clients, the same array JSON-encoded in a string. A single line
+// item object, bare or in a string, is read as a one item array. Items may
+// repeat the order currency but not name another one. The free-form objects
+// and empty lists older clients sent are refused: they carry no prices to
+// total the order from.
+func parseItems(raw json.RawMessage, currency string) ([]OrderItem, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		var legacy string
+		if err := json.Unmarshal(raw, &legacy); err != nil {
+			return nil, errors.New("items must be an array of line items")
+		}
+		raw = bytes.TrimSpace(json.RawMessage(legacy))
+	}
+	if len(raw) > 0 && raw[0] == '{' {
+		raw = append(append(json.RawMessage{'['}, raw...), ']')
+	}
+	var in []itemInput
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, fmt.Errorf("items must be an array of line items: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if len(in) == 0 || len(in) > maxOrderItems {
+		return nil, fmt.Errorf("an order needs between 1 and %d items", maxOrderItems)
+	}
+	items := make([]OrderItem, len(in))
+	for i, it := range in {
+		switch {
+		case it.SKU == "" && it.ProductID == "":
+			return nil, fmt.Errorf("items[%d] needs a sku or a product_id", i)
+		case len(it.SKU) > 64 || len(it.ProductID) > 64 || len(it.Name) > 200:
+			return nil, fmt.Errorf("items[%d] has a field that is too long", i)
+		case it.Quantity < 1 || it.Quantity > maxItemQuantity:
+			return nil, fmt.Errorf("items[%d].quantity must be between 1 and %d", i, maxItemQuantity)
+		case it.Currency != "" && !strings.EqualFold(it.Currency, currency):
+			return nil, fmt.Errorf("items[%d].currency %s does not match the order currency %s", i, it.Currency, currency)
+		case it.UnitPrice == nil:
+			return nil, fmt.Errorf("items[%d].unit_price is required", i)
+		}
+		price, err := parseAmount(it.UnitPrice, currency)
+		if err != nil {
+			return nil, fmt.Errorf("items[%d].unit_price %s", i, err)
+		}
+		if price < 0 || price > maxUnitPrice {
+			return nil, fmt.Errorf("items[%d].unit_price must be between 0 and %s", i, maxUnitPrice.format(currencyExponent(currency)))
+		}
+		items[i] = OrderItem{SKU: it.SKU, ProductID: it.ProductID, Name: it.Name, Quantity: it.Quantity, Currency: currency, UnitPrice: price, Position: i}
+	}
+	return items, nil
+}
+
+// migrateLegacyItems moves orders created before line items had their own
+// table out of the old orders.items JSON column. Converted orders get the
+// column cleared so this only ever looks at each order once. Items that
+// cannot be read are moved to legacy_items and returned as they are until
+// someone fixes the order by hand. Such old orders predate currencies and
+// are read in the currency the order was backfilled with.
+func migrateLegacyItems(db *gorm.DB) error {
+	if !db.Migrator().HasColumn("orders", "items") {
+		return nil
+	}
+	var rows []struct {
+		ID       uuid.UUID
+		Items    string
+		Currency string
+	}
+	if err := db.Table("orders").Select("id, items, currency").Where("items IS NOT NULL").Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var items []OrderItem
+		if row.Items != "" && row.Items != "[]" && row.Items != "null" {
+			var err error
+			if items, err = parseItems(json.RawMessage(row.Items), row.Currency); err != nil {
+				log.Warn().Err(err).Str("order_id", row.ID.String()).Msg("legacy_items_not_migrated")
+				if err := db.Table("orders").Where("id = ?", row.ID).Updates(map[string]interface{}{"legacy_items": row.Items, "items": nil}).Error; err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for i := range items {
+				items[i].OrderID = row.ID
+				items[i].LineTotal = items[i].UnitPrice * Money(items[i].Quantity)
+				if err := tx.Create(&items[i]).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Table("orders").Where("id = ?", row.ID).Update("items", nil).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// jwksCache verifies tokens issued by service_users against its published
+// JWKS. Keys are refetched every refresh interval and, at most once per
+// minRefetch, when a token carries an unknown kid so a rotation is picked up
+// without waiting. A failed fetch keeps the previous keys.
+type jwksCache struct {
+	url        string
+	client     *http.Client
+	refresh    time.Duration
+	minRefetch time.Duration
+
+	mu        sync.RWMutex
+	keys      map[string]jwk
+	fetchedAt time.Time
+	fetchMu   sync.Mutex
+	attempted time.Time
+}
+
+type jwk struct {
+	alg string
+	pub crypto.PublicKey
+}
+
+var jwks = newJWKSCache(getEnvOrders("JWKS_URL", "http://service_users:8000/.well-known/jwks.json"), getEnvOrders("JWKS_REFRESH", "5m"))
+
+func newJWKSCache(url, refresh string) *jwksCache {
+	d, err := time.ParseDuration(refresh)
+	if err != nil || d <= 0 {
+		d = 5 * time.Minute
+	}
+	return &jwksCache{url: url, client: &http.Client{Timeout: 5 * time.Second}, refresh: d, minRefetch: 10 * time.Second}
+}
+
+// keyfunc is a jwt.Keyfunc accepting EdDSA and RS256 tokens with a known kid.
+func (c *jwksCache) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		return nil, jwt.ErrTokenUnverifiable
+	}
+	k, ok := c.lookup(kid)
+	if !ok || k.alg != t.Method.Alg() {
+		return nil, jwt.ErrTokenUnverifiable
+	}
+	return k.pub, nil
+}
+
+func (c *jwksCache) lookup(kid string) (jwk, bool) {
+	c.mu.RLock()
+	k, ok := c.keys[kid]
+	stale := time.Since(c.fetchedAt) > c.refresh
+	c.mu.RUnlock()
+	if ok && !stale {
+		return k, true
+	}
+	c.fetch(ok)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	k, ok = c.keys[kid]
+	return k, ok
+}
+
+// fetch refreshes the key set. When known is false it is throttled by
+// minRefetch so tokens with made up kids cannot hammer the issuer.
+func (c *jwksCache) fetch(known bool) {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	c.mu.RLock()
+	fresh := time.Since(c.fetchedAt) <= c.refresh
+	c.mu.RUnlock()
+	if (known && fresh) || time.Since(c.attempted) < c.minRefetch {
+		return
+	}
+	c.attempted = time.Now()
+	keys, err := c.download()
+	if err != nil {
+		log.Warn().Err(err).Str("url", c.url).Msg("jwks_fetch_failed")
+		return
+	}
+	c.mu.Lock()
+	c.keys, c.fetchedAt = keys, time.Now()
+	c.mu.Unlock()
+}
+
+func (c *jwksCache) download() (map[string]jwk, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: unexpected status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Alg string `json:"alg"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	b64 := base64.RawURLEncoding
+	keys := map[string]jwk{}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := b64.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[k.Kid] = jwk{alg: jwt.SigningMethodEdDSA.Alg(), pub: ed25519.PublicKey(x)}
+		case k.Kty == "RSA":
+			n, err1 := b64.DecodeString(k.N)
+			e, err2 := b64.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys[k.Kid] = jwk{alg: jwt.SigningMethodRS256.Alg(), pub: pub}
+		}
+	}
+	return keys, nil
+}
@@ -7,13 +7,10 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-var jwtSecretOrders = []byte(getEnvOrders("JWT_SECRET", "dev-secret"))
-
 func getEnvOrders(k, def string) string {
 	v := os.Getenv(k)
 	if v == "" {
@@ -22,39 +19,14 @@ func getEnvOrders(k, def string) string {
 	return v
 }
 
+// OrderAuthMiddleware identifies the caller (see authMode) and sets user context.
 func OrderAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		auth := c.GetHeader("Authorization")
-		if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "missing token"}})
-			return
-		}
-		tokenStr := strings.TrimPrefix(auth, "Bearer ")
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-			if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-				return nil, jwt.ErrTokenUnverifiable
-			}
-			return jwtSecretOrders, nil
-		})
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "invalid token"}})
+		sub, roles, err := requestIdentity(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": err.Error()}})
 			return
 		}
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "invalid token claims"}})
-			return
-		}
-		sub, _ := claims["sub"].(string)
-		rolesIface := claims["roles"]
-		var roles []string
-		if rolesSlice, ok := rolesIface.([]interface{}); ok {
-			for _, r := range rolesSlice {
-				if s, ok := r.(string); ok {
-					roles = append(roles, s)
-				}
-			}
-		}
 		c.Set("user_id", sub)
 		c.Set("roles", roles)
 		c.Next()
@@ -1,7 +1,77 @@
 package main
 
-import "gorm.io/gorm"
+import (
+	"fmt"
+	"math"
+
+	"gorm.io/gorm"
+)
 
 func migrateOrders(db *gorm.DB) error {
-	return db.AutoMigrate(&Order{})
+	m := db.Migrator()
+	// amounts used to be float columns; they are converted once, in the
+	// default currency
+	floatOrders := m.HasColumn("orders", "total") && !m.HasColumn("orders", "total_minor")
+	floatBreakdown := m.HasColumn("orders", "subtotal")
+	floatItems := m.HasColumn("order_items", "unit_price") && !m.HasColumn("order_items", "unit_price_minor")
+	floatRate := m.HasColumn("orders", "tax_rate") && !m.HasColumn("orders", "tax_rate_ppm")
+	if err := db.AutoMigrate(&Order{}, &OrderItem{}, &OrderStatusHistory{}); err != nil {
+		return err
+	}
+	cur := defaultCurrency()
+	for _, table := range []string{"orders", "order_items"} {
+		if err := db.Table(table).Where("currency = '' OR currency IS NULL").Update("currency", cur).Error; err != nil {
+			return err
+		}
+	}
+	scale := math.Pow10(currencyExponent(cur))
+	if floatOrders {
+		// orders placed before totals were computed here have no breakdown;
+		// their total is kept as the subtotal
+		set := "total_minor = ROUND(COALESCE(total, 0) * ?), subtotal_minor = ROUND(COALESCE(total, 0) * ?)"
+		args := []interface{}{scale, scale}
+		drop := []string{"total"}
+		if floatBreakdown {
+			set = "total_minor = ROUND(COALESCE(total, 0) * ?), subtotal_minor = ROUND(subtotal * ?), discount_minor = ROUND(discount * ?), tax_minor = ROUND(tax * ?)"
+			args = []interface{}{scale, scale, scale, scale}
+			drop = append(drop, "subtotal", "discount", "tax")
+		}
+		if err := migrateFloatColumns(db, "orders", set, args, drop); err != nil {
+			return err
+		}
+	}
+	if floatItems {
+		drop := []string{"unit_price"}
+		if m.HasColumn("order_items", "line_total") {
+			drop = append(drop, "line_total")
+		}
+		if err := migrateFloatColumns(db, "order_items", "unit_price_minor = ROUND(unit_price * ?)", []interface{}{scale}, drop); err != nil {
+			return err
+		}
+		if err := db.Exec("UPDATE order_items SET line_total_minor = unit_price_minor * quantity").Error; err != nil {
+			return err
+		}
+	}
+	if floatRate {
+		if err := migrateFloatColumns(db, "orders", "tax_rate_ppm = ROUND(tax_rate * ?)", []interface{}{rateUnits}, []string{"tax_rate"}); err != nil {
+			return err
+		}
+	}
+	return migrateLegacyItems(db)
+}
+
+// migrateFloatColumns fills the minor unit columns of table from its float
+// columns and then drops those.
+func migrateFloatColumns(db *gorm.DB, table, set string, args []interface{}, drop []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s", table, set), args...).Error; err != nil {
+			return err
+		}
+		for _, col := range drop {
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, col)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
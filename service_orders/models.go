@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,13 +9,64 @@ import (
 )
 
 type Order struct {
+	ID          uuid.UUID   `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID      uuid.UUID   `gorm:"type:uuid;index;not null" json:"user_id"`
+	Items       []OrderItem `gorm:"constraint:OnDelete:CASCADE" json:"items"`
+	LegacyItems *string     `gorm:"type:text" json:"legacy_items,omitempty"` // old items JSON that could not be converted
+	Status      string      `gorm:"type:text;default:'created'" json:"status"`
+	Currency    string      `gorm:"size:3;not null;default:''" json:"currency"`
+	Total       Money       `gorm:"column:total_minor;not null;default:0" json:"-"`
+	Breakdown   Breakdown   `gorm:"embedded" json:"-"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// MarshalJSON writes amounts as decimal strings in the order's currency.
+func (o Order) MarshalJSON() ([]byte, error) {
+	type plain Order
+	return json.Marshal(struct {
+		plain
+		Total     string        `json:"total"`
+		Breakdown breakdownJSON `json:"breakdown"`
+	}{plain(o), o.Total.format(currencyExponent(o.Currency)), o.Breakdown.json(o.Currency)})
+}
+
+// OrderItem is one line of an order. Items are identified by sku, product_id
+// or both, and are always in the currency of their order.
+type OrderItem struct {
 	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	UserID    uuid.UUID `gorm:"type:uuid;index;not null" json:"user_id"`
-	Items     string    `gorm:"type:jsonb" json:"items"`
-	Status    string    `gorm:"type:text;default:'created'" json:"status"`
-	Total     float64   `json:"total"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	OrderID   uuid.UUID `gorm:"type:uuid;index;not null" json:"-"`
+	Position  int       `gorm:"not null;default:0" json:"-"`
+	SKU       string    `json:"sku,omitempty"`
+	ProductID string    `json:"product_id,omitempty"`
+	Name      string    `json:"name"`
+	Quantity  int       `gorm:"not null" json:"quantity"`
+	Currency  string    `gorm:"size:3;not null;default:''" json:"currency"`
+	UnitPrice Money     `gorm:"column:unit_price_minor;not null;default:0" json:"-"`
+	LineTotal Money     `gorm:"column:line_total_minor;not null;default:0" json:"-"`
+}
+
+// MarshalJSON writes amounts as decimal strings in the item's currency.
+func (i OrderItem) MarshalJSON() ([]byte, error) {
+	type plain OrderItem
+	exp := currencyExponent(i.Currency)
+	return json.Marshal(struct {
+		plain
+		UnitPrice string `json:"unit_price"`
+		LineTotal string `json:"line_total"`
+	}{plain(i), i.UnitPrice.format(exp), i.LineTotal.format(exp)})
+}
+
+func (i *OrderItem) BeforeCreate(tx *gorm.DB) (err error) {
+	if i.ID == uuid.Nil {
+		i.ID = uuid.New()
+	}
+	return nil
+}
+
+// withItems preloads order items in the order they were given.
+func withItems(db *gorm.DB) *gorm.DB {
+	return db.Preload("Items", func(tx *gorm.DB) *gorm.DB { return tx.Order("position") })
 }
 
 func (o *Order) BeforeCreate(tx *gorm.DB) (err error) {
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in minor units of its order's currency (cents for USD,
+// yen for JPY). It is serialised as a decimal string by the types holding it,
+// since only they know the currency.
+type Money int64
+
+// currencies maps the ISO 4217 codes orders may use to their number of minor
+// unit digits.
+var currencies = map[string]int{
+	"AUD": 2, "BYN": 2, "CAD": 2, "CHF": 2, "CNY": 2, "CZK": 2, "DKK": 2,
+	"EUR": 2, "GBP": 2, "INR": 2, "KZT": 2, "NOK": 2, "PLN": 2, "RUB": 2,
+	"SEK": 2, "TRY": 2, "UAH": 2, "USD": 2,
+	"JPY": 0, "KRW": 0,
+	"BHD": 3, "KWD": 3,
+}
+
+// defaultCurrency is used for orders that do not name one and for orders
+// created before currencies were recorded.
+func defaultCurrency() string {
+	return strings.ToUpper(getEnvOrders("ORDER_DEFAULT_CURRENCY", "USD"))
+}
+
+// currencyExponent returns the minor unit digits of code, 2 if unknown.
+func currencyExponent(code string) int {
+	if exp, ok := currencies[code]; ok {
+		return exp
+	}
+	return 2
+}
+
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+var errNotDecimal = errors.New("must be a plain decimal amount")
+
+// parseMinor reads a decimal such as "12.5" as a count of 10^-exp units.
+// Digits beyond exp are refused unless they are zeros, so nothing is ever
+// rounded away.
+func parseMinor(s string, exp int) (int64, error) {
+	if !decimalPattern.MatchString(s) {
+		return 0, errNotDecimal
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > exp {
+		return 0, fmt.Errorf("has more than %d decimal places", exp)
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+	v, err := strconv.ParseInt(strings.TrimPrefix(whole, "-")+frac, 10, 64)
+	if err != nil {
+		return 0, errors.New("is too large")
+	}
+	if strings.HasPrefix(whole, "-") {
+		v = -v
+	}
+	return v, nil
+}
+
+// parseAmount reads an amount sent either as a JSON string ("10.50") or,
+// as older clients do, a JSON number.
+func parseAmount(raw json.RawMessage, currency string) (Money, error) {
+	raw = bytes.TrimSpace(raw)
+	s := string(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return 0, errNotDecimal
+		}
+	}
+	v, err := parseMinor(s, currencyExponent(currency))
+	return Money(v), err
+}
+
+// format renders m with exp decimal places.
+func (m Money) format(exp int) string {
+	v := int64(m)
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	s := strconv.FormatInt(v, 10)
+	if exp == 0 {
+		return sign + s
+	}
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+	return sign + s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+// rateUnits is the scale of rates: parts per million.
+const rateUnits = 1_000_000
+
+// applyRate returns m * rate/rateUnits rounded half up. big.Int keeps the
+// intermediate product from overflowing.
+func (m Money) applyRate(rate int64) Money {
+	p := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(rate))
+	p.Add(p, big.NewInt(rateUnits/2))
+	return Money(p.Quo(p, big.NewInt(rateUnits)).Int64())
+}
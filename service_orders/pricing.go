@@ -0,0 +1,67 @@
+package main
+
+import "strconv"
+
+// Breakdown shows how an order's total was computed from its items.
+type Breakdown struct {
+	Subtotal Money `gorm:"column:subtotal_minor;not null;default:0"`
+	Discount Money `gorm:"column:discount_minor;not null;default:0"`
+	Tax      Money `gorm:"column:tax_minor;not null;default:0"`
+	TaxRate  int64 `gorm:"column:tax_rate_ppm;not null;default:0"` // in rateUnits, as charged
+}
+
+type breakdownJSON struct {
+	Subtotal string  `json:"subtotal"`
+	Discount string  `json:"discount"`
+	Tax      string  `json:"tax"`
+	TaxRate  float64 `json:"tax_rate"`
+}
+
+func (b Breakdown) json(currency string) breakdownJSON {
+	exp := currencyExponent(currency)
+	rate, _ := strconv.ParseFloat(Money(b.TaxRate).format(6), 64)
+	return breakdownJSON{Subtotal: b.Subtotal.format(exp), Discount: b.Discount.format(exp), Tax: b.Tax.format(exp), TaxRate: rate}
+}
+
+// pricing holds the rules applied to an order. Rates are in rateUnits.
+type pricing struct {
+	taxRate          int64
+	discountRate     int64
+	discountMinTotal Money
+}
+
+// pricingFromEnv reads ORDER_TAX_RATE and ORDER_DISCOUNT_RATE, given as
+// fractions (0.2 means 20%), and ORDER_DISCOUNT_MIN_SUBTOTAL, in major
+// units of currency. Unset or invalid values mean no tax and no discount.
+func pricingFromEnv(currency string) pricing {
+	p := pricing{taxRate: envRate("ORDER_TAX_RATE"), discountRate: envRate("ORDER_DISCOUNT_RATE")}
+	if v, err := parseMinor(getEnvOrders("ORDER_DISCOUNT_MIN_SUBTOTAL", "0"), currencyExponent(currency)); err == nil && v > 0 {
+		p.discountMinTotal = Money(v)
+	}
+	return p
+}
+
+func envRate(k string) int64 {
+	v, err := parseMinor(getEnvOrders(k, "0"), 6)
+	if err != nil || v < 0 || v > rateUnits {
+		return 0
+	}
+	return v
+}
+
+// price fills in the line totals of items and returns the breakdown and the
+// grand total. The discount applies to the subtotal once it reaches
+// discountMinTotal; tax is charged on what is left after the discount.
+func (p pricing) price(items []OrderItem) (Breakdown, Money) {
+	var b Breakdown
+	for i := range items {
+		items[i].LineTotal = items[i].UnitPrice * Money(items[i].Quantity)
+		b.Subtotal += items[i].LineTotal
+	}
+	if p.discountRate > 0 && b.Subtotal >= p.discountMinTotal {
+		b.Discount = b.Subtotal.applyRate(p.discountRate)
+	}
+	b.TaxRate = p.taxRate
+	b.Tax = (b.Subtotal - b.Discount).applyRate(p.taxRate)
+	return b, b.Subtotal - b.Discount + b.Tax
+}
@@ -0,0 +1,62 @@
+package main
+
+import "sort"
+
+// Order statuses. done and cancelled are final.
+const (
+	statusCreated    = "created"
+	statusInProgress = "in_progress"
+	statusDone       = "done"
+	statusCancelled  = "cancelled"
+)
+
+// Actors a transition can be granted to. roleOwner is whoever placed the
+// order; the others are token roles.
+const (
+	roleOwner = "owner"
+	roleAdmin = "admin"
+)
+
+// orderTransitions lists, for each status, the statuses it may move to and
+// who may make that move. Owners can only cancel an order nobody has started
+// working on.
+var orderTransitions = map[string]map[string][]string{
+	statusCreated: {
+		statusInProgress: {roleAdmin},
+		statusCancelled:  {roleOwner, roleAdmin},
+	},
+	statusInProgress: {
+		statusDone:      {roleAdmin},
+		statusCancelled: {roleAdmin},
+	},
+}
+
+func knownStatus(s string) bool {
+	switch s {
+	case statusCreated, statusInProgress, statusDone, statusCancelled:
+		return true
+	}
+	return false
+}
+
+// nextStatuses returns the statuses actors may move an order in from to,
+// sorted.
+func nextStatuses(from string, actors []string) []string {
+	next := []string{}
+	for to, allowed := range orderTransitions[from] {
+		if anyOf(allowed, actors) {
+			next = append(next, to)
+		}
+	}
+	sort.Strings(next)
+	return next
+}
+
+func anyOf(allowed, actors []string) bool {
+	for _, a := range actors {
+		if contains(allowed, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+var errSelfAction = errors.New("admins cannot do this to their own account")
+
+type adminUpdateUserRequest struct {
+	Name  *string `json:"name" binding:"omitnil,min=1,max=100"`
+	Email *string `json:"email" binding:"omitnil,email"`
+}
+
+type roleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// adminUser loads the user named by the :id parameter, answering the request
+// itself when it cannot.
+func adminUser(c *gin.Context, db *gorm.DB) (User, bool) {
+	var u User
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_id", "message": "invalid user id"}})
+		return u, false
+	}
+	if err := db.Where("id = ?", uid).First(&u).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+		return u, false
+	}
+	return u, true
+}
+
+// notSelf refuses actions an admin could lock themselves out with.
+func notSelf(c *gin.Context, u User) bool {
+	if c.GetString("user_id") == u.ID.String() {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "self_action", "message": errSelfAction.Error()}})
+		return false
+	}
+	return true
+}
+
+// setRoles stores roles; the sessions of the user are ended so that tokens
+// carrying the old roles stop working.
+func setRoles(tx *gorm.DB, u User, roles []string) error {
+	if err := tx.Model(&User{}).Where("id = ?", u.ID).Update("roles", pqStringArray(roles)).Error; err != nil {
+		return err
+	}
+	_, err := revokeUserSessions(tx, u.ID)
+	return err
+}
+
+func registerAdminHandlers(users *gin.RouterGroup, db *gorm.DB) {
+	admin := AuthMiddleware(db, true)
+
+	users.GET("/:id", admin, func(c *gin.Context) {
+		if u, ok := adminUser(c, db); ok {
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": u})
+		}
+	})
+
+	users.PATCH("/:id", admin, func(c *gin.Context) {
+		u, ok := adminUser(c, db)
+		if !ok {
+			return
+		}
+		var req adminUpdateUserRequest
+		if err := bindStrict(c, &req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		updates := map[string]interface{}{}
+		var fields []string
+		if req.Name != nil {
+			updates["name"] = *req.Name
+			fields = append(fields, "name")
+		}
+		emailChanged := req.Email != nil && strings.ToLower(*req.Email) != u.Email
+		if emailChanged {
+			email := strings.ToLower(*req.Email)
+			var taken int64
+			db.Model(&User{}).Where("email = ?", email).Count(&taken)
+			if taken > 0 {
+				c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "email_exists", "message": "Email already registered"}})
+				return
+			}
+			// the new address has to be verified by its owner
+			updates["email"] = email
+			updates["email_verified_at"] = nil
+			updates["pending_email"] = ""
+			fields = append(fields, "email")
+		}
+		if len(updates) == 0 {
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": u})
+			return
+		}
+		var token string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("id = ?", u.ID).First(&u).Error; err != nil {
+				return err
+			}
+			if emailChanged {
+				var err error
+				if token, err = issueVerificationToken(tx, u); err != nil {
+					return err
+				}
+			}
+			return recordAudit(tx, c, u.ID, auditUserUpdated, strings.Join(fields, ","))
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot update user"}})
+			return
+		}
+		if emailChanged {
+			mailVerification(u, token)
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": u})
+	})
+
+	users.POST("/:id/roles", admin, func(c *gin.Context) {
+		u, ok := adminUser(c, db)
+		if !ok {
+			return
+		}
+		var req roleRequest
+		if err := bindStrict(c, &req); err != nil || !roleName.MatchString(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": "role must be a lowercase name"}})
+			return
+		}
+		if !contains(u.Roles, req.Role) {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := setRoles(tx, u, append(u.Roles, req.Role)); err != nil {
+					return err
+				}
+				return recordAudit(tx, c, u.ID, auditRoleAdded, req.Role)
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot update roles"}})
+				return
+			}
+			u.Roles = append(u.Roles, req.Role)
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"roles": u.Roles}})
+	})
+
+	users.DELETE("/:id/roles/:role", admin, func(c *gin.Context) {
+		u, ok := adminUser(c, db)
+		if !ok {
+			return
+		}
+		role := c.Param("role")
+		if role == "admin" && !notSelf(c, u) {
+			return
+		}
+		if contains(u.Roles, role) {
+			var rest pqStringArray
+			for _, r := range u.Roles {
+				if r != role {
+					rest = append(rest, r)
+				}
+			}
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := setRoles(tx, u, rest); err != nil {
+					return err
+				}
+				return recordAudit(tx, c, u.ID, auditRoleRemoved, role)
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot update roles"}})
+				return
+			}
+			u.Roles = rest
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"roles": u.Roles}})
+	})
+
+	// a disabled user cannot log in and every session they had is ended
+	users.POST("/:id/disable", admin, func(c *gin.Context) {
+		u, ok := adminUser(c, db)
+		if !ok || !notSelf(c, u) {
+			return
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ? AND disabled_at IS NULL", u.ID).Update("disabled_at", time.Now()).Error; err != nil {
+				return err
+			}
+			if _, err := revokeUserSessions(tx, u.ID); err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditUserDisabled, "")
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot disable user"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	users.POST("/:id/enable", admin, func(c *gin.Context) {
+		u, ok := adminUser(c, db)
+		if !ok {
+			return
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Update("disabled_at", nil).Error; err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditUserEnabled, "")
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot enable user"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	// the audit trail outlives the user
+	users.DELETE("/:id", admin, func(c *gin.Context) {
+		u, ok := adminUser(c, db)
+		if !ok || !notSelf(c, u) {
+			return
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if _, err := revokeUserSessions(tx, u.ID); err != nil {
+				return err
+			}
+			for _, m := range []interface{}{&RefreshToken{}, &ActionToken{}, &RecoveryCode{}} {
+				if err := tx.Where("user_id = ?", u.ID).Delete(m).Error; err != nil {
+					return err
+				}
+			}
+			if err := logins.reset(tx, u.Email); err != nil {
+				return err
+			}
+			if err := tx.Delete(&User{}, "id = ?", u.ID).Error; err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditUserDeleted, u.Email)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot delete user"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	users.GET("/:id/audit", admin, func(c *gin.Context) {
+		uid, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_id", "message": "invalid user id"}})
+			return
+		}
+		var events []AuditEvent
+		if err := db.Where("user_id = ?", uid).Order("created_at desc").Limit(100).Find(&events).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "DB error"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": events})
+	})
+}
+
+// userDisabled reports whether the account uid has been disabled.
+func userDisabled(db *gorm.DB, uid string) bool {
+	var n int64
+	db.Model(&User{}).Where("id = ? AND disabled_at IS NOT NULL", uid).Count(&n)
+	return n > 0
+}
+
+func accountDisabled(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "account_disabled", "message": "account is disabled"}})
+}
+
+func contains(arr []string, v string) bool {
+	for _, s := range arr {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Audit actions.
+const (
+	auditPasswordChanged = "password_changed"
+	auditMFAEnabled      = "mfa_enabled"
+	auditMFADisabled     = "mfa_disabled"
+	auditAccountUnlocked = "account_unlocked"
+	auditEmailChanged    = "email_changed"
+	auditUserUpdated     = "user_updated"
+	auditRoleAdded       = "role_added"
+	auditRoleRemoved     = "role_removed"
+	auditUserDisabled    = "user_disabled"
+	auditUserEnabled     = "user_enabled"
+	auditUserDeleted     = "user_deleted"
+)
+
+// AuditEvent records a security relevant change to an account. ActorID is who
+// made it, which differs from UserID when an admin acts on someone else.
+type AuditEvent struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID    uuid.UUID `gorm:"type:uuid;index;not null" json:"user_id"`
+	ActorID   uuid.UUID `gorm:"type:uuid;index" json:"actor_id"`
+	Action    string    `gorm:"index;not null" json:"action"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (e *AuditEvent) BeforeCreate(tx *gorm.DB) (err error) {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+// recordAudit stores action on uid, attributed to the caller of c. detail is
+// free text such as the role added.
+func recordAudit(tx *gorm.DB, c *gin.Context, uid uuid.UUID, action, detail string) error {
+	actor, _ := uuid.Parse(c.GetString("user_id"))
+	return tx.Create(&AuditEvent{
+		UserID:    uid,
+		ActorID:   actor,
+		Action:    action,
+		Detail:    detail,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}).Error
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -20,7 +23,35 @@ type loginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
 func RegisterHandlers(r *gin.Engine, db *gorm.DB) {
+	// liveness/readiness probe used by the gateway health checks
+	r.GET("/healthz", func(c *gin.Context) {
+		sqlDB, err := db.DB()
+		if err == nil {
+			err = sqlDB.PingContext(c.Request.Context())
+		}
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "error": gin.H{"code": "db_unavailable", "message": "database unreachable"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"status": "ok"}})
+	})
+
+	// public keys for verifying our tokens; cached by the gateway and services
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		ring, err := signingKeys()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "keys_unavailable", "message": "signing keys unavailable"}})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, ring.jwks())
+	})
+
 	v1 := r.Group("/v1")
 
 	users := v1.Group("/users")
@@ -41,12 +72,26 @@ func RegisterHandlers(r *gin.Engine, db *gorm.DB) {
 				return
 			}
 
+			if err := checkPasswordPolicy(req.Password); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "weak_password", "message": err.Error()}})
+				return
+			}
 			hash, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 			u := User{Email: strings.ToLower(req.Email), Password: string(hash), Name: req.Name, Roles: pqStringArray{"user"}}
-			if err := db.Create(&u).Error; err != nil {
+			var token string
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Create(&u).Error; err != nil {
+					return err
+				}
+				var err error
+				token, err = issueVerificationToken(tx, u)
+				return err
+			})
+			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot create user"}})
 				return
 			}
+			mailVerification(u, token)
 			c.JSON(http.StatusCreated, gin.H{"success": true, "data": gin.H{"id": u.ID}})
 		})
 
@@ -56,33 +101,83 @@ func RegisterHandlers(r *gin.Engine, db *gorm.DB) {
 				c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
 				return
 			}
+			email := strings.ToLower(req.Email)
+			policy := loginPolicyFromEnv()
+			if wait := logins.check(db, policy, c.ClientIP(), email); wait > 0 {
+				tooManyAttempts(c, wait)
+				return
+			}
 			var u User
-			if err := db.Where("email = ?", strings.ToLower(req.Email)).First(&u).Error; err != nil {
+			if err := db.Where("email = ?", email).First(&u).Error; err != nil {
+				// unknown emails cost a bcrypt comparison too so timing does
+				// not tell them apart
+				compareDummyPassword(req.Password)
+				if err := logins.fail(db, policy, c.ClientIP(), email); err != nil {
+					log.Error().Err(err).Msg("login_throttle_failed")
+				}
 				c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "invalid_credentials", "message": "invalid credentials"}})
 				return
 			}
 			if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)) != nil {
+				if err := logins.fail(db, policy, c.ClientIP(), email); err != nil {
+					log.Error().Err(err).Msg("login_throttle_failed")
+				}
 				c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "invalid_credentials", "message": "invalid credentials"}})
 				return
 			}
-			token, err := GenerateJWT(u.ID.String(), []string(u.Roles))
+			if u.DisabledAt != nil {
+				accountDisabled(c)
+				return
+			}
+			// failures are only forgotten once the second factor is in too,
+			// so TOTP guesses count against the same lockout
+			if u.MFAEnabledAt != nil {
+				mfaChallenge(c, db, u)
+				return
+			}
+			if err := logins.reset(db, email); err != nil {
+				log.Error().Err(err).Msg("login_throttle_failed")
+			}
+			tokens, err := issueTokens(db, u, uuid.New(), false)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "token_error", "message": "cannot generate token"}})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"token": token}})
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": tokens})
 		})
 
-		users.GET("/", AuthMiddleware(db, true), func(c *gin.Context) {
-			// admin only list
-			// pagination
-			var users []User
-			limit := 20
-			offset := 0
-			db.Limit(limit).Offset(offset).Find(&users)
-			c.JSON(http.StatusOK, gin.H{"success": true, "data": users})
+		users.POST("/token/refresh", func(c *gin.Context) {
+			var req refreshRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+				return
+			}
+			tokens, err := rotateRefreshToken(db, req.RefreshToken)
+			switch {
+			case errors.Is(err, errRefreshReused):
+				c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "refresh_token_reused", "message": "refresh token was already used, session revoked"}})
+				return
+			case errors.Is(err, errRefreshInvalid):
+				c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "invalid_refresh_token", "message": "invalid or expired refresh token"}})
+				return
+			case err != nil:
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "token_error", "message": "cannot refresh token"}})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": tokens})
 		})
 
+		registerRevocationHandlers(r, users, db)
+		registerPasswordHandlers(users, db)
+		registerVerifyHandlers(users, db)
+		registerMFAHandlers(users, db)
+		registerThrottleHandlers(users, db)
+		registerProfileHandlers(users, db)
+		registerAdminHandlers(users, db)
+
+		// admin only list
+		users.GET("/", AuthMiddleware(db, true), listUsers(db))
+
 		users.GET("/me", AuthMiddleware(db, false), func(c *gin.Context) {
 			uid := c.GetString("user_id")
 			var u User
@@ -94,21 +189,27 @@ func RegisterHandlers(r *gin.Engine, db *gorm.DB) {
 			c.JSON(http.StatusOK, gin.H{"success": true, "data": u})
 		})
 
+		// email and password have their own endpoints; any field not in
+		// updateProfileRequest is refused
 		users.PUT("/me", AuthMiddleware(db, false), func(c *gin.Context) {
 			uid := c.GetString("user_id")
-			var updates map[string]interface{}
-			if err := c.ShouldBindJSON(&updates); err != nil {
+			var req updateProfileRequest
+			if err := bindStrict(c, &req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
 				return
 			}
-			// disallow role changes and password here
-			delete(updates, "roles")
-			delete(updates, "password")
-			if err := db.Model(&User{}).Where("id = ?", uid).Updates(updates).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot update"}})
+			if updates := req.updates(); len(updates) > 0 {
+				if err := db.Model(&User{}).Where("id = ?", uid).Updates(updates).Error; err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot update"}})
+					return
+				}
+			}
+			var u User
+			if err := db.Where("id = ?", uid).First(&u).Error; err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"success": true})
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": u})
 		})
 	}
 }
@@ -2,26 +2,41 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/glebarez/sqlite"
+	"github.com/golang-jwt/jwt/v5"
 	"gorm.io/gorm"
 )
 
 func setupTestServer(t *testing.T) (*gin.Engine, *gorm.DB) {
-	os.Setenv("JWT_SECRET", "test-secret")
 	db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
 	if err != nil {
 		t.Fatalf("failed open db: %v", err)
 	}
-	if err := db.AutoMigrate(&User{}); err != nil {
+	if err := migrate(db); err != nil {
 		t.Fatalf("migrate failed: %v", err)
 	}
+	logins = &loginThrottle{ips: map[string]*ipAttempts{}}
+	resetRequests = &requestLimiter{hits: map[string]*requestWindow{}}
 	r := gin.New()
 	r.Use(gin.Recovery())
 	r.Use(RequestIDMiddleware())
@@ -148,3 +163,809 @@ func TestDuplicateRegistrationAndUpdateProfile(t *testing.T) {
 		t.Fatalf("expected name updated to Dup2, got %v", gdata["name"])
 	}
 }
+
+func TestHealthz(t *testing.T) {
+	r, _ := setupTestServer(t)
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("healthz failed: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestKeyRotationAndJWKS(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(kid string, priv any) {
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			t.Fatalf("marshal key: %v", err)
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+			t.Fatalf("write key: %v", err)
+		}
+	}
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey("2024-01", rsaKey)
+	writeKey("2024-02", edKey)
+
+	old, err := loadKeyRing(dir, "2024-01")
+	if err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+	oldToken, err := old.sign(jwt.MapClaims{"sub": "u1"})
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	ring, err := loadKeyRing(dir, "")
+	if err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+	if ring.active.kid != "2024-02" || ring.active.method != jwt.SigningMethodEdDSA {
+		t.Fatalf("expected the newest key to be active, got %s", ring.active.kid)
+	}
+	if _, err := jwt.Parse(oldToken, ring.keyfunc); err != nil {
+		t.Fatalf("token signed by the previous key should still verify: %v", err)
+	}
+
+	jwks, _ := json.Marshal(ring.jwks())
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	json.Unmarshal(jwks, &set)
+	if len(set.Keys) != 2 || set.Keys[0]["kty"] != "RSA" || set.Keys[0]["alg"] != "RS256" || set.Keys[1]["crv"] != "Ed25519" {
+		t.Fatalf("unexpected jwks %s", jwks)
+	}
+	for _, k := range set.Keys {
+		if k["d"] != "" {
+			t.Fatalf("private key material leaked in jwks: %s", jwks)
+		}
+	}
+
+	r, _ := setupTestServer(t)
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"kid"`)) {
+		t.Fatalf("jwks endpoint failed: %d %s", w.Code, w.Body.String())
+	}
+}
+
+// doJSON sends body as JSON (nil for none) with an optional bearer token and
+// returns the recorder together with the decoded response.
+func doJSON(r *gin.Engine, method, path, token string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	var rd *bytes.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	} else {
+		rd = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, rd)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+// registerAndLogin creates a user and returns the login response data.
+func registerAndLogin(t *testing.T, r *gin.Engine, email string) map[string]interface{} {
+	t.Helper()
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/register", "", map[string]string{"email": email, "password": "password", "name": "Test"}); w.Code != http.StatusCreated {
+		t.Fatalf("register failed: %d %s", w.Code, w.Body.String())
+	}
+	w, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": email, "password": "password"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login failed: %d %s", w.Code, w.Body.String())
+	}
+	return resp["data"].(map[string]interface{})
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	r, _ := setupTestServer(t)
+	login := registerAndLogin(t, r, "refresh@example.com")
+	first := login["refresh_token"].(string)
+	if login["access_token"] == "" || first == "" || login["expires_in"].(float64) != 900 {
+		t.Fatalf("unexpected login response %v", login)
+	}
+
+	w, resp := doJSON(r, http.MethodPost, "/v1/users/token/refresh", "", map[string]string{"refresh_token": first})
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh failed: %d %s", w.Code, w.Body.String())
+	}
+	data := resp["data"].(map[string]interface{})
+	second := data["refresh_token"].(string)
+	if second == first {
+		t.Fatalf("expected the refresh token to rotate")
+	}
+	successor := data["access_token"].(string)
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", successor, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected refreshed access token to work, got %d", w.Code)
+	}
+
+	// replaying the spent token revokes the whole family, including its successor
+	w, resp = doJSON(r, http.MethodPost, "/v1/users/token/refresh", "", map[string]string{"refresh_token": first})
+	if w.Code != http.StatusUnauthorized || resp["error"].(map[string]interface{})["code"] != "refresh_token_reused" {
+		t.Fatalf("expected reuse to be detected, got %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/token/refresh", "", map[string]string{"refresh_token": second}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the rest of the family to be revoked, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", successor, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected access tokens of the reused session to be revoked, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/token/refresh", "", map[string]string{"refresh_token": "bogus"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unknown refresh token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestLogoutAndAdminRevokeSessions(t *testing.T) {
+	r, db := setupTestServer(t)
+	t.Setenv("INTERNAL_AUTH_KEY", "internal-test-key")
+	victim := registerAndLogin(t, r, "revoke@example.com")
+	access := victim["access_token"].(string)
+
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/logout", access, nil); w.Code != http.StatusOK {
+		t.Fatalf("logout failed: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", access, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected logged out token to be rejected, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/token/refresh", "", map[string]string{"refresh_token": victim["refresh_token"].(string)}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected logout to end the refresh session, got %d", w.Code)
+	}
+
+	// two fresh sessions, both ended by an admin
+	var sessions []string
+	for i := 0; i < 2; i++ {
+		_, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "revoke@example.com", "password": "password"})
+		sessions = append(sessions, resp["data"].(map[string]interface{})["access_token"].(string))
+	}
+	registerAndLogin(t, r, "revoke-admin@example.com")
+	db.Model(&User{}).Where("email = ?", "revoke-admin@example.com").Update("roles", "{user,admin}")
+	_, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "revoke-admin@example.com", "password": "password"})
+	adminToken := resp["data"].(map[string]interface{})["access_token"].(string)
+	var u User
+	db.Where("email = ?", "revoke@example.com").First(&u)
+
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/"+u.ID.String()+"/sessions/revoke", sessions[0], nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin to be refused, got %d", w.Code)
+	}
+	stale := Revocation{Kind: revokeSID, Value: "stale", ExpiresAt: time.Now().Add(-time.Minute)}
+	db.Create(&stale)
+	w, resp := doJSON(r, http.MethodPost, "/v1/users/"+u.ID.String()+"/sessions/revoke", adminToken, nil)
+	if w.Code != http.StatusOK || resp["data"].(map[string]interface{})["revoked_sessions"].(float64) != 2 {
+		t.Fatalf("revoke sessions failed: %d %s", w.Code, w.Body.String())
+	}
+	// writing new entries prunes expired ones, not only logout
+	var n int64
+	db.Model(&Revocation{}).Where("id = ?", stale.ID).Count(&n)
+	if n != 0 {
+		t.Fatalf("expected the expired revocation to be pruned")
+	}
+	for _, tok := range sessions {
+		if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", tok, nil); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected revoked session token to be rejected, got %d", w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/internal/revocations", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected internal endpoint to require the internal key, got %d", w.Code)
+	}
+	req.Header.Set("X-Internal-Key", "internal-test-key")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"kind":"sid"`)) || !bytes.Contains(w.Body.Bytes(), []byte(`"kind":"jti"`)) {
+		t.Fatalf("unexpected revocation list: %d %s", w.Code, w.Body.String())
+	}
+}
+
+// captureMail routes outgoing mail into a temp dir for the test and returns a
+// function that waits for a message to an address with the given subject.
+func captureMail(t *testing.T) func(to, subject string) string {
+	dir := t.TempDir()
+	prev := mailer
+	mailer = &logMailer{dir: dir, from: "test@example.com"}
+	t.Cleanup(func() { mailer = prev })
+	return func(to, subject string) string {
+		t.Helper()
+		for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+			for i := len(files) - 1; i >= 0; i-- {
+				b, _ := os.ReadFile(files[i])
+				if strings.Contains(string(b), "To: "+to+"\r\n") && strings.Contains(string(b), "Subject: "+subject+"\r\n") {
+					os.Remove(files[i])
+					return string(b)
+				}
+			}
+		}
+		t.Fatalf("no %q mail to %s", subject, to)
+		return ""
+	}
+}
+
+var linkToken = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+func TestPasswordResetFlow(t *testing.T) {
+	r, db := setupTestServer(t)
+	// the old password is tried below; do not let that delay the next login
+	t.Setenv("LOGIN_DELAY", "1ns")
+	waitMail := captureMail(t)
+	login := registerAndLogin(t, r, "reset@example.com")
+
+	w, resp := doJSON(r, http.MethodPost, "/v1/users/password/forgot", "", map[string]string{"email": "reset@example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("forgot failed: %d %s", w.Code, w.Body.String())
+	}
+	w2, resp2 := doJSON(r, http.MethodPost, "/v1/users/password/forgot", "", map[string]string{"email": "nobody@example.com"})
+	if w2.Code != w.Code || resp2["message"] != resp["message"] {
+		t.Fatalf("forgot must not reveal whether an email is registered: %s vs %s", w.Body.String(), w2.Body.String())
+	}
+	m := linkToken.FindStringSubmatch(waitMail("reset@example.com", "Reset your password"))
+	if m == nil {
+		t.Fatalf("no reset link in mail")
+	}
+	token := m[1]
+
+	// repeated requests are limited per email, registered or not, and per IP
+	for _, email := range []string{"reset@example.com", "nobody@example.com"} {
+		w, resp := doJSON(r, http.MethodPost, "/v1/users/password/forgot", "", map[string]string{"email": email})
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || resp["error"].(map[string]interface{})["code"] != "too_many_requests" {
+			t.Fatalf("expected a repeated request for %s to be limited, got %d %s", email, w.Code, w.Body.String())
+		}
+	}
+	t.Setenv("PASSWORD_RESET_IP_MAX", "4")
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/password/forgot", "", map[string]string{"email": "third@example.com"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the IP to be limited, got %d", w.Code)
+	}
+	// a link that is still fresh is not replaced
+	sendPasswordReset(db, "reset@example.com")
+	var tokens int64
+	db.Model(&ActionToken{}).Where("purpose = ?", purposePasswordReset).Count(&tokens)
+	if tokens != 1 {
+		t.Fatalf("expected the recent reset token to be kept, got %d tokens", tokens)
+	}
+
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/password/reset", "", map[string]string{"token": token, "password": "123"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected weak password to be refused, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/password/reset", "", map[string]string{"token": token, "password": "new-password"}); w.Code != http.StatusOK {
+		t.Fatalf("reset failed: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/password/reset", "", map[string]string{"token": token, "password": "other-password"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected reset token to be single use, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "reset@example.com", "password": "password"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected old password to stop working, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "reset@example.com", "password": "new-password"}); w.Code != http.StatusOK {
+		t.Fatalf("expected login with the new password, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", login["access_token"].(string), nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected sessions from before the reset to be revoked, got %d", w.Code)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	r, db := setupTestServer(t)
+	waitMail := captureMail(t)
+	t.Setenv("EMAIL_VERIFY_RESEND_INTERVAL", "1h")
+	login := registerAndLogin(t, r, "verify@example.com")
+	access := login["access_token"].(string)
+
+	_, resp := doJSON(r, http.MethodGet, "/v1/users/me", access, nil)
+	if resp["data"].(map[string]interface{})["email_verified_at"] != nil {
+		t.Fatalf("expected a new user to be unverified")
+	}
+	first := linkToken.FindStringSubmatch(waitMail("verify@example.com", "Confirm your email"))[1]
+
+	// resending replaces the first link, and is throttled
+	db.Model(&ActionToken{}).Where("purpose = ?", purposeEmailVerify).Update("created_at", time.Now().Add(-2*time.Hour))
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/verify-email/resend", access, nil); w.Code != http.StatusOK {
+		t.Fatalf("resend failed: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/verify-email/resend", access, nil); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected resend to be throttled, got %d", w.Code)
+	}
+	second := linkToken.FindStringSubmatch(waitMail("verify@example.com", "Confirm your email"))[1]
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/verify-email", "", map[string]string{"token": first}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected the superseded link to be rejected, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/verify-email", "", map[string]string{"token": second}); w.Code != http.StatusOK {
+		t.Fatalf("verify failed: %d %s", w.Code, w.Body.String())
+	}
+	_, resp = doJSON(r, http.MethodGet, "/v1/users/me", access, nil)
+	if resp["data"].(map[string]interface{})["email_verified_at"] == nil {
+		t.Fatalf("expected email_verified_at to be set")
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/verify-email/resend", access, nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected resend after verification to conflict, got %d", w.Code)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	r, db := setupTestServer(t)
+	current := registerAndLogin(t, r, "change@example.com")
+	_, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "change@example.com", "password": "password"})
+	other := resp["data"].(map[string]interface{})
+	access := current["access_token"].(string)
+
+	if w, _ := doJSON(r, http.MethodPut, "/v1/users/me/password", access, map[string]string{"current_password": "wrong", "new_password": "new-password"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected wrong current password to be refused, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPut, "/v1/users/me/password", access, map[string]string{"current_password": "password", "new_password": "short"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected weak password to be refused, got %d", w.Code)
+	}
+	w, resp := doJSON(r, http.MethodPut, "/v1/users/me/password", access, map[string]string{"current_password": "password", "new_password": "new-password"})
+	if w.Code != http.StatusOK || resp["data"].(map[string]interface{})["revoked_sessions"].(float64) != 1 {
+		t.Fatalf("change password failed: %d %s", w.Code, w.Body.String())
+	}
+
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", access, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected current session to survive, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", other["access_token"].(string), nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected other session to be revoked, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "change@example.com", "password": "new-password"}); w.Code != http.StatusOK {
+		t.Fatalf("login with new password failed: %d", w.Code)
+	}
+
+	var events []AuditEvent
+	db.Where("action = ?", auditPasswordChanged).Find(&events)
+	if len(events) != 1 || events[0].UserID != events[0].ActorID {
+		t.Fatalf("expected one audit event by the user, got %+v", events)
+	}
+}
+
+func TestTOTPTwoFactorLogin(t *testing.T) {
+	r, db := setupTestServer(t)
+	t.Setenv("LOGIN_DELAY", "1ns")
+	session := registerAndLogin(t, r, "mfa@example.com")
+	access := session["access_token"].(string)
+
+	w, resp := doJSON(r, http.MethodPost, "/v1/users/me/mfa/totp", access, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll failed: %d %s", w.Code, w.Body.String())
+	}
+	data := resp["data"].(map[string]interface{})
+	secret := data["secret"].(string)
+	if !strings.HasPrefix(data["otpauth_uri"].(string), "otpauth://totp/") {
+		t.Fatalf("unexpected otpauth uri %v", data["otpauth_uri"])
+	}
+	step := time.Now().Unix() / totpPeriod
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/me/mfa/totp/confirm", access, map[string]string{"code": totpCode(secret, step+5)}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected wrong code to be refused, got %d", w.Code)
+	}
+	w, resp = doJSON(r, http.MethodPost, "/v1/users/me/mfa/totp/confirm", access, map[string]string{"code": totpCode(secret, step)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm failed: %d %s", w.Code, w.Body.String())
+	}
+	recovery := resp["data"].(map[string]interface{})["recovery_codes"].([]interface{})
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(recovery))
+	}
+
+	login := func() string {
+		w, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "mfa@example.com", "password": "password"})
+		data := resp["data"].(map[string]interface{})
+		if w.Code != http.StatusOK || data["mfa_required"] != true || data["access_token"] != nil {
+			t.Fatalf("expected an MFA challenge: %d %s", w.Code, w.Body.String())
+		}
+		return data["mfa_token"].(string)
+	}
+
+	// the code used to confirm enrollment cannot be replayed
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/login/mfa", "", map[string]string{"mfa_token": login(), "code": totpCode(secret, step)}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected replayed code to be refused, got %d", w.Code)
+	}
+	w, resp = doJSON(r, http.MethodPost, "/v1/users/login/mfa", "", map[string]string{"mfa_token": login(), "code": totpCode(secret, step+1)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("mfa login failed: %d %s", w.Code, w.Body.String())
+	}
+	mfaAccess := resp["data"].(map[string]interface{})["access_token"].(string)
+
+	code := recovery[0].(string)
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/login/mfa", "", map[string]string{"mfa_token": login(), "recovery_code": code}); w.Code != http.StatusOK {
+		t.Fatalf("recovery code login failed: %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/login/mfa", "", map[string]string{"mfa_token": login(), "recovery_code": code}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected used recovery code to be refused, got %d", w.Code)
+	}
+
+	// with MFA_REQUIRED_FOR_ADMIN only the MFA session gets admin access
+	t.Setenv("MFA_REQUIRED_FOR_ADMIN", "true")
+	db.Model(&User{}).Where("email = ?", "mfa@example.com").Update("roles", "{user,admin}")
+	_, resp = doJSON(r, http.MethodPost, "/v1/users/login/mfa", "", map[string]string{"mfa_token": login(), "recovery_code": recovery[1].(string)})
+	adminMFA := resp["data"].(map[string]interface{})["access_token"].(string)
+	registerAndLogin(t, r, "nomfa-admin@example.com")
+	db.Model(&User{}).Where("email = ?", "nomfa-admin@example.com").Update("roles", "{user,admin}")
+	_, resp = doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "nomfa-admin@example.com", "password": "password"})
+	adminPassword := resp["data"].(map[string]interface{})["access_token"].(string)
+
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/", adminPassword, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected admin without MFA to be refused, got %d", w.Code)
+	}
+	// the role is left out of the token so the gateway and orders refuse it too
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(adminPassword, claims); err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if roles := claims["roles"].([]interface{}); len(roles) != 1 || roles[0] != "user" {
+		t.Fatalf("expected a password only session to carry no admin role, got %v", roles)
+	}
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/", adminMFA, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected admin with MFA to be allowed, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", mfaAccess, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected MFA session to work, got %d", w.Code)
+	}
+
+	// turning MFA off takes a second factor as well as the password
+	if w, _ := doJSON(r, http.MethodDelete, "/v1/users/me/mfa", mfaAccess, map[string]string{"password": "password"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected disabling without a code to be refused, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodDelete, "/v1/users/me/mfa", mfaAccess, map[string]string{"password": "password", "code": totpCode(secret, step+5)}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected disabling with a wrong code to be refused, got %d", w.Code)
+	}
+	// and guessing codes there is throttled like logging in
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+	doJSON(r, http.MethodDelete, "/v1/users/me/mfa", mfaAccess, map[string]string{"password": "password", "code": totpCode(secret, step+6)})
+	w, resp = doJSON(r, http.MethodDelete, "/v1/users/me/mfa", mfaAccess, map[string]string{"password": "password", "recovery_code": recovery[2].(string)})
+	if w.Code != http.StatusTooManyRequests || resp["error"].(map[string]interface{})["code"] != "too_many_attempts" {
+		t.Fatalf("expected code guessing to be locked out, got %d %s", w.Code, w.Body.String())
+	}
+	logins.reset(db, "mfa@example.com")
+	if w, _ := doJSON(r, http.MethodDelete, "/v1/users/me/mfa", mfaAccess, map[string]string{"password": "password", "recovery_code": recovery[2].(string)}); w.Code != http.StatusOK {
+		t.Fatalf("disable failed: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLoginThrottleAndUnlock(t *testing.T) {
+	r, db := setupTestServer(t)
+	login := func(email, password string) *httptest.ResponseRecorder {
+		w, _ := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": email, "password": password})
+		return w
+	}
+
+	// a failure delays the next attempt, whether or not the account exists
+	t.Setenv("LOGIN_DELAY", "1h")
+	if w := login("ghost@example.com", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+	if w := login("ghost@example.com", "wrong"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected delayed retry, got %d", w.Code)
+	}
+
+	t.Setenv("LOGIN_DELAY", "1ns")
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+	registerAndLogin(t, r, "locked@example.com")
+	for i := 0; i < 3; i++ {
+		if w := login("locked@example.com", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, w.Code)
+		}
+	}
+	if w := login("locked@example.com", "password"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected locked account to be refused, got %d", w.Code)
+	}
+
+	registerAndLogin(t, r, "unlock-admin@example.com")
+	db.Model(&User{}).Where("email = ?", "unlock-admin@example.com").Update("roles", "{user,admin}")
+	_, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "unlock-admin@example.com", "password": "password"})
+	adminToken := resp["data"].(map[string]interface{})["access_token"].(string)
+	var u User
+	db.Where("email = ?", "locked@example.com").First(&u)
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/"+u.ID.String()+"/unlock", adminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("unlock failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := login("locked@example.com", "password"); w.Code != http.StatusOK {
+		t.Fatalf("expected unlocked account to log in, got %d", w.Code)
+	}
+
+	// wrong MFA codes count as failed logins even though the password is right
+	mfaUser := registerAndLogin(t, r, "mfa-locked@example.com")
+	_, resp = doJSON(r, http.MethodPost, "/v1/users/me/mfa/totp", mfaUser["access_token"].(string), nil)
+	secret := resp["data"].(map[string]interface{})["secret"].(string)
+	step := time.Now().Unix() / totpPeriod
+	doJSON(r, http.MethodPost, "/v1/users/me/mfa/totp/confirm", mfaUser["access_token"].(string), map[string]string{"code": totpCode(secret, step)})
+	for i := 0; i < 3; i++ {
+		w, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "mfa-locked@example.com", "password": "password"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("attempt %d: expected an MFA challenge, got %d %s", i, w.Code, w.Body.String())
+		}
+		token := resp["data"].(map[string]interface{})["mfa_token"].(string)
+		if w, _ := doJSON(r, http.MethodPost, "/v1/users/login/mfa", "", map[string]string{"mfa_token": token, "code": totpCode(secret, step+5)}); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected wrong code to be refused, got %d", i, w.Code)
+		}
+	}
+	w, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "mfa-locked@example.com", "password": "password"})
+	if w.Code != http.StatusTooManyRequests || resp["error"].(map[string]interface{})["code"] != "too_many_attempts" {
+		t.Fatalf("expected wrong MFA codes to lock the account, got %d %s", w.Code, w.Body.String())
+	}
+
+	// the IP is locked out separately, for every account
+	t.Setenv("LOGIN_IP_MAX_FAILURES", "5")
+	login("other-ghost@example.com", "wrong")
+	if w := login("locked@example.com", "password"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected locked IP to be refused, got %d", w.Code)
+	}
+}
+
+func TestProfileUpdateAllowlistAndEmailChange(t *testing.T) {
+	r, _ := setupTestServer(t)
+	waitMail := captureMail(t)
+	access := registerAndLogin(t, r, "profile@example.com")["access_token"].(string)
+
+	for _, body := range []map[string]interface{}{
+		{"email": "evil@example.com"},
+		{"roles": []string{"admin"}},
+		{"created_at": "2000-01-01T00:00:00Z"},
+		{"name": ""},
+		{"phone": "12345"},
+		{"locale": "not a locale"},
+		{"avatar_url": "javascript:alert(1)"},
+	} {
+		w, resp := doJSON(r, http.MethodPut, "/v1/users/me", access, body)
+		if w.Code != http.StatusBadRequest || resp["error"].(map[string]interface{})["code"] != "invalid_input" {
+			t.Fatalf("expected %v to be refused, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	w, resp := doJSON(r, http.MethodPut, "/v1/users/me", access, map[string]interface{}{"email": "evil@example.com"})
+	if !strings.Contains(resp["error"].(map[string]interface{})["message"].(string), `unknown field "email"`) {
+		t.Fatalf("expected the unknown field to be named: %s", w.Body.String())
+	}
+
+	w, resp = doJSON(r, http.MethodPut, "/v1/users/me", access, map[string]string{"name": "New Name", "phone": "+14155550123", "locale": "en-US", "avatar_url": "https://cdn.example.com/a.png"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update failed: %d %s", w.Code, w.Body.String())
+	}
+	data := resp["data"].(map[string]interface{})
+	if data["name"] != "New Name" || data["phone"] != "+14155550123" || data["locale"] != "en-US" || data["email"] != "profile@example.com" {
+		t.Fatalf("unexpected profile %v", data)
+	}
+	_, resp = doJSON(r, http.MethodPut, "/v1/users/me", access, map[string]string{"phone": ""})
+	if data := resp["data"].(map[string]interface{}); data["phone"] != "" || data["name"] != "New Name" {
+		t.Fatalf("expected only phone to be cleared, got %v", data)
+	}
+
+	registerAndLogin(t, r, "taken@example.com")
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/me/email", access, map[string]string{"email": "new@example.com", "password": "wrong"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected wrong password to be refused, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/me/email", access, map[string]string{"email": "taken@example.com", "password": "password"}); w.Code != http.StatusConflict {
+		t.Fatalf("expected taken email to be refused, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/me/email", access, map[string]string{"email": "New@example.com", "password": "password"}); w.Code != http.StatusAccepted {
+		t.Fatalf("email change failed: %d %s", w.Code, w.Body.String())
+	}
+	// nothing changes until the new address is confirmed
+	if w := login(t, r, "profile@example.com"); w.Code != http.StatusOK {
+		t.Fatalf("expected old email to work until confirmed, got %d", w.Code)
+	}
+	m := linkToken.FindStringSubmatch(waitMail("new@example.com", "Confirm your new email"))
+	if m == nil {
+		t.Fatalf("no confirmation link in mail")
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/email/confirm", "", map[string]string{"token": m[1]}); w.Code != http.StatusOK {
+		t.Fatalf("confirm failed: %d %s", w.Code, w.Body.String())
+	}
+	waitMail("profile@example.com", "Your email was changed")
+	if w := login(t, r, "new@example.com"); w.Code != http.StatusOK {
+		t.Fatalf("expected login with the new email, got %d", w.Code)
+	}
+	_, resp = doJSON(r, http.MethodGet, "/v1/users/me", access, nil)
+	if data := resp["data"].(map[string]interface{}); data["email"] != "new@example.com" || data["email_verified_at"] == nil {
+		t.Fatalf("unexpected profile after email change %v", data)
+	}
+}
+
+func login(t *testing.T, r *gin.Engine, email string) *httptest.ResponseRecorder {
+	t.Helper()
+	w, _ := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": email, "password": "password"})
+	return w
+}
+
+func adminLogin(t *testing.T, r *gin.Engine, db *gorm.DB, email string) string {
+	t.Helper()
+	registerAndLogin(t, r, email)
+	db.Model(&User{}).Where("email = ?", email).Update("roles", "{user,admin}")
+	_, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": email, "password": "password"})
+	return resp["data"].(map[string]interface{})["access_token"].(string)
+}
+
+func TestAdminUserManagement(t *testing.T) {
+	r, db := setupTestServer(t)
+	admin := adminLogin(t, r, db, "manager@example.com")
+	session := registerAndLogin(t, r, "managed@example.com")
+	var u User
+	db.Where("email = ?", "managed@example.com").First(&u)
+	path := "/v1/users/" + u.ID.String()
+
+	if w, _ := doJSON(r, http.MethodGet, path, session["access_token"].(string), nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin to be refused, got %d", w.Code)
+	}
+	if w, resp := doJSON(r, http.MethodGet, path, admin, nil); w.Code != http.StatusOK || resp["data"].(map[string]interface{})["email"] != "managed@example.com" {
+		t.Fatalf("get user failed: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := doJSON(r, http.MethodPatch, path, admin, map[string]string{"password": "x"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown field to be refused, got %d", w.Code)
+	}
+	w, resp := doJSON(r, http.MethodPatch, path, admin, map[string]string{"name": "Renamed", "email": "renamed@example.com"})
+	data := resp["data"].(map[string]interface{})
+	if w.Code != http.StatusOK || data["name"] != "Renamed" || data["email"] != "renamed@example.com" || data["email_verified_at"] != nil {
+		t.Fatalf("update user failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w, resp = doJSON(r, http.MethodPost, path+"/roles", admin, map[string]string{"role": "support"})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"support"`) {
+		t.Fatalf("add role failed: %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := doJSON(r, http.MethodPost, path+"/roles", admin, map[string]string{"role": "Bad Role"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid role to be refused, got %d", w.Code)
+	}
+	// changing roles ends the sessions that carry the old ones
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/me", session["access_token"].(string), nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected session to end on role change, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodDelete, path+"/roles/support", admin, nil); w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"support"`) {
+		t.Fatalf("remove role failed: %d %s", w.Code, w.Body.String())
+	}
+	var me User
+	db.Where("email = ?", "manager@example.com").First(&me)
+	if w, _ := doJSON(r, http.MethodDelete, "/v1/users/"+me.ID.String()+"/roles/admin", admin, nil); w.Code != http.StatusConflict {
+		t.Fatalf("expected admin to be unable to drop their own admin role, got %d", w.Code)
+	}
+
+	_, resp = doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "renamed@example.com", "password": "password"})
+	refresh := resp["data"].(map[string]interface{})["refresh_token"].(string)
+	if w, _ := doJSON(r, http.MethodPost, path+"/disable", admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("disable failed: %d", w.Code)
+	}
+	if w, resp := doJSON(r, http.MethodPost, "/v1/users/login", "", map[string]string{"email": "renamed@example.com", "password": "password"}); w.Code != http.StatusForbidden || resp["error"].(map[string]interface{})["code"] != "account_disabled" {
+		t.Fatalf("expected disabled user to be refused at login, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, "/v1/users/token/refresh", "", map[string]string{"refresh_token": refresh}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected disabled user's refresh token to stop working, got %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodPost, path+"/enable", admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("enable failed: %d", w.Code)
+	}
+	if w := login(t, r, "renamed@example.com"); w.Code != http.StatusOK {
+		t.Fatalf("expected enabled user to log in, got %d", w.Code)
+	}
+
+	if w, _ := doJSON(r, http.MethodDelete, path, admin, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d", w.Code)
+	}
+	if w, _ := doJSON(r, http.MethodGet, path, admin, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected deleted user to be gone, got %d", w.Code)
+	}
+	w, resp = doJSON(r, http.MethodGet, path+"/audit", admin, nil)
+	var actions []string
+	for _, e := range resp["data"].([]interface{}) {
+		ev := e.(map[string]interface{})
+		if ev["actor_id"] != me.ID.String() {
+			t.Fatalf("expected the admin as actor, got %v", ev)
+		}
+		actions = append(actions, ev["action"].(string))
+	}
+	for _, want := range []string{auditUserUpdated, auditRoleAdded, auditRoleRemoved, auditUserDisabled, auditUserEnabled, auditUserDeleted} {
+		if !contains(actions, want) {
+			t.Fatalf("audit log %v lacks %s", actions, want)
+		}
+	}
+}
+
+func TestDisabledUserRejectedByAuthMiddleware(t *testing.T) {
+	r, db := setupTestServer(t)
+	t.Setenv("AUTH_MODE", "gateway")
+	t.Setenv("INTERNAL_AUTH_KEY", "internal-test-key")
+	registerAndLogin(t, r, "disabled@example.com")
+	var u User
+	db.Where("email = ?", "disabled@example.com").First(&u)
+	me := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte("internal-test-key"))
+		mac.Write([]byte("v1\n" + u.ID.String() + "\nuser\n" + ts))
+		req.Header.Set("X-User-ID", u.ID.String())
+		req.Header.Set("X-User-Roles", "user")
+		req.Header.Set("X-Identity-Timestamp", ts)
+		req.Header.Set("X-Identity-Signature", hex.EncodeToString(mac.Sum(nil)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := me(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	db.Model(&User{}).Where("id = ?", u.ID).Update("disabled_at", time.Now())
+	if code := me(); code != http.StatusForbidden {
+		t.Fatalf("expected disabled user to be refused, got %d", code)
+	}
+}
+
+func TestAdminUserListQueries(t *testing.T) {
+	r, db := setupTestServer(t)
+	admin := adminLogin(t, r, db, "lister@example.com")
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Now()
+	for i, name := range []string{"Alice", "bob", "Carol", "dave", "Eve"} {
+		u := User{Email: strings.ToLower(name) + "@list.example", Name: name, Password: "x", Roles: pqStringArray{"user"}, CreatedAt: base.AddDate(0, i, 0)}
+		if name == "Carol" {
+			u.Roles = pqStringArray{"user", "admin"}
+		}
+		if name == "dave" {
+			u.DisabledAt = &now
+		}
+		if err := db.Create(&u).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	list := func(query string) ([]string, map[string]interface{}) {
+		t.Helper()
+		w, resp := doJSON(r, http.MethodGet, "/v1/users/?email_domain=list.example&"+query, admin, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list %q failed: %d %s", query, w.Code, w.Body.String())
+		}
+		var names []string
+		for _, u := range resp["data"].([]interface{}) {
+			names = append(names, u.(map[string]interface{})["name"].(string))
+		}
+		return names, resp["meta"].(map[string]interface{})
+	}
+	expect := func(query string, want ...string) {
+		t.Helper()
+		if got, _ := list(query); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s: got %v, want %v", query, got, want)
+		}
+	}
+
+	names, meta := list("size=2&page=2&sort=email")
+	if strings.Join(names, ",") != "Carol,dave" || meta["total"].(float64) != 5 || meta["total_pages"].(float64) != 3 || meta["page"].(float64) != 2 {
+		t.Fatalf("unexpected page: %v %v", names, meta)
+	}
+
+	// walking the cursor visits every user once, in order
+	for _, sort := range []string{"-created_at", "name", "-email"} {
+		var all []string
+		cursor := ""
+		for i := 0; i < 5; i++ {
+			names, meta := list("size=2&sort=" + sort + "&cursor=" + cursor)
+			all = append(all, names...)
+			next, _ := meta["next_cursor"].(string)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		// names sort bytewise in sqlite, so capitals come first
+		want := map[string]string{"-created_at": "Eve,dave,Carol,bob,Alice", "name": "Alice,Carol,Eve,bob,dave", "-email": "Eve,dave,Carol,bob,Alice"}[sort]
+		if strings.Join(all, ",") != want {
+			t.Fatalf("cursor walk by %s: got %v, want %s", sort, all, want)
+		}
+	}
+
+	expect("sort=email&q=ALI", "Alice")
+	expect("sort=email&q=list.example&role=admin", "Carol")
+	expect("sort=email&disabled=true", "dave")
+	expect("sort=email&created_after=2024-02-01&created_before=2024-04-01", "bob", "Carol")
+
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/?sort=password", admin, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown sort to be refused, got %d", w.Code)
+	}
+	_, meta = list("size=2&sort=email")
+	if w, _ := doJSON(r, http.MethodGet, "/v1/users/?sort=name&cursor="+meta["next_cursor"].(string), admin, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected cursor for another sort to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// signingKey is one private key of the key ring, identified by its kid.
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	priv   crypto.Signer
+}
+
+// keyRing holds every key whose public half is published in the JWKS. Only
+// active signs new tokens; the others stay published so tokens they signed
+// keep verifying during a rotation.
+type keyRing struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var (
+	keysOnce sync.Once
+	keys     *keyRing
+	keysErr  error
+)
+
+// signingKeys loads the key ring on first use.
+func signingKeys() (*keyRing, error) {
+	keysOnce.Do(func() {
+		keys, keysErr = loadKeyRing(getEnv("JWT_KEYS_DIR", ""), getEnv("JWT_ACTIVE_KID", ""))
+	})
+	return keys, keysErr
+}
+
+// loadKeyRing reads every <kid>.pem PKCS#8 Ed25519 or RSA private key in dir.
+// activeKid defaults to the last kid in lexical order, so naming keys by date
+// rotates by just adding a file. Without a dir a throwaway Ed25519 key is
+// generated, which is only good for a single instance in development.
+func loadKeyRing(dir, activeKid string) (*keyRing, error) {
+	ring := &keyRing{keys: map[string]*signingKey{}}
+	if dir == "" {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, 8)
+		rand.Read(b)
+		k := &signingKey{kid: "dev-" + hex.EncodeToString(b), method: jwt.SigningMethodEdDSA, priv: priv}
+		ring.keys[k.kid], ring.active = k, k
+		log.Warn().Str("kid", k.kid).Msg("JWT_KEYS_DIR is not set, using an ephemeral signing key")
+		return ring, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		k, err := readSigningKey(f)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[k.kid] = k
+		if activeKid == "" || k.kid == activeKid {
+			ring.active = k
+		}
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("no *.pem keys in %s", dir)
+	}
+	if activeKid != "" && ring.active.kid != activeKid {
+		return nil, fmt.Errorf("JWT_ACTIVE_KID %q not found in %s", activeKid, dir)
+	}
+	return ring, nil
+}
+
+func readSigningKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	k := &signingKey{kid: strings.TrimSuffix(filepath.Base(path), ".pem")}
+	switch priv := parsed.(type) {
+	case ed25519.PrivateKey:
+		k.method, k.priv = jwt.SigningMethodEdDSA, priv
+	case *rsa.PrivateKey:
+		k.method, k.priv = jwt.SigningMethodRS256, priv
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, parsed)
+	}
+	return k, nil
+}
+
+func (r *keyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.active.method, claims)
+	token.Header["kid"] = r.active.kid
+	return token.SignedString(r.active.priv)
+}
+
+// keyfunc verifies tokens signed by any key of the ring.
+func (r *keyRing) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k, ok := r.keys[kid]
+	if !ok || t.Method.Alg() != k.method.Alg() {
+		return nil, jwt.ErrTokenUnverifiable
+	}
+	return k.priv.Public(), nil
+}
+
+// jwks renders the public keys as a JSON Web Key Set (RFC 7517).
+func (r *keyRing) jwks() gin.H {
+	kids := make([]string, 0, len(r.keys))
+	for kid := range r.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	out := make([]gin.H, 0, len(kids))
+	b64 := base64.RawURLEncoding
+	for _, kid := range kids {
+		k := r.keys[kid]
+		jwk := gin.H{"kid": kid, "use": "sig", "alg": k.method.Alg()}
+		switch pub := k.priv.Public().(type) {
+		case ed25519.PublicKey:
+			jwk["kty"], jwk["crv"], jwk["x"] = "OKP", "Ed25519", b64.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = b64.EncodeToString(pub.N.Bytes())
+			jwk["e"] = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		}
+		out = append(out, jwk)
+	}
+	return gin.H{"keys": out}
+}
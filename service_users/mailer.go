@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// mailer is the process wide Mailer, chosen by MAILER at start up. Tests swap
+// it for a logMailer writing into a temp dir.
+var mailer Mailer = newMailerFromEnv()
+
+// newMailerFromEnv returns an smtpMailer for MAILER=smtp and a logMailer
+// otherwise.
+func newMailerFromEnv() Mailer {
+	from := getEnv("MAIL_FROM", "no-reply@example.com")
+	if getEnv("MAILER", "log") == "smtp" {
+		return &smtpMailer{
+			addr:     getEnv("SMTP_ADDR", "localhost:25"),
+			username: getEnv("SMTP_USERNAME", ""),
+			password: getEnv("SMTP_PASSWORD", ""),
+			from:     from,
+		}
+	}
+	return &logMailer{dir: getEnv("MAIL_DIR", ""), from: from}
+}
+
+type smtpMailer struct {
+	addr, username, password, from string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, _ := net.SplitHostPort(m.addr)
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, render(m.from, msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logMailer is for local development and tests: messages are logged and,
+// when dir is set, also written there as .eml files.
+type logMailer struct {
+	dir, from string
+}
+
+func (m *logMailer) Send(ctx context.Context, msg Message) error {
+	log.Info().Str("to", msg.To).Str("subject", msg.Subject).Msg("mail_sent")
+	if m.dir == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), uuid.New().String()[:8])
+	return os.WriteFile(filepath.Join(m.dir, name), render(m.from, msg), 0o600)
+}
+
+func render(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", from, msg.To, msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// sendAsync delivers msg in the background so that handlers answer in the
+// same time whether or not they had anything to send.
+func sendAsync(msg Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Error().Err(err).Str("subject", msg.Subject).Msg("mail_failed")
+		}
+	}()
+}
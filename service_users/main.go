@@ -4,6 +4,7 @@ import (
 	"fmt"
 	stdlog "log"
 	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	zlog "github.com/rs/zerolog/log"
@@ -28,7 +29,18 @@ func main() {
 		stdlog.Fatalf("migrate failed: %v", err)
 	}
 
+	if _, err := signingKeys(); err != nil {
+		stdlog.Fatalf("load signing keys: %v", err)
+	}
+
 	r := gin.New()
+	// behind api_gateway set this to the gateway's addresses so that the
+	// per-IP login throttle sees the real client from X-Forwarded-For
+	if proxies := getEnv("TRUSTED_PROXIES", ""); proxies != "" {
+		if err := r.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
+			stdlog.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+		}
+	}
 	r.Use(gin.Recovery())
 
 	// middleware
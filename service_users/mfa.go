@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// TOTP parameters (RFC 6238). They are the defaults every authenticator app
+// assumes, so they are not configurable.
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+)
+
+const purposeMFAChallenge = "mfa_challenge"
+
+// Authentication methods recorded in the access token's amr claim (RFC 8176).
+const (
+	amrPassword = "pwd"
+	amrOTP      = "otp"
+)
+
+// RecoveryCode is a one time code that stands in for a TOTP code when the
+// authenticator is lost. Only its sha256 hash is stored.
+type RecoveryCode struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index;not null" json:"user_id"`
+	CodeHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (rc *RecoveryCode) BeforeCreate(tx *gorm.DB) (err error) {
+	if rc.ID == uuid.Nil {
+		rc.ID = uuid.New()
+	}
+	return nil
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode is the code for time step step.
+func totpCode(secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return ""
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// verifyTOTP accepts code for the current time step or one step either side,
+// to allow for clock drift, and returns the step it matched. Steps up to
+// after are refused so a code cannot be replayed.
+func verifyTOTP(secret, code string, after int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if secret == "" || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for step := cur - 1; step <= cur+1; step++ {
+		if step > after && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI authenticator apps read from a QR code.
+func totpURI(secret, account string) string {
+	issuer := getEnv("MFA_ISSUER", "Users")
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// replaceRecoveryCodes drops the user's old recovery codes and returns a new
+// set. The plain codes are only ever shown in this response.
+func replaceRecoveryCodes(tx *gorm.DB, uid uuid.UUID) ([]string, error) {
+	if err := tx.Where("user_id = ?", uid).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+		if err := tx.Create(&RecoveryCode{UserID: uid, CodeHash: hashToken(normalizeRecoveryCode(codes[i]))}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// useSecondFactor checks a TOTP code or, failing that, a recovery code for
+// u and spends it.
+func useSecondFactor(db *gorm.DB, u User, code, recovery string) bool {
+	if code != "" {
+		step, ok := verifyTOTP(u.TOTPSecret, code, u.TOTPLastStep, time.Now())
+		if !ok {
+			return false
+		}
+		// the step guard stops a concurrent replay of the same code
+		res := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", u.ID, step).Update("totp_last_step", step)
+		return res.Error == nil && res.RowsAffected == 1
+	}
+	if recovery != "" {
+		res := db.Model(&RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", u.ID, hashToken(normalizeRecoveryCode(recovery))).
+			Update("used_at", time.Now())
+		return res.Error == nil && res.RowsAffected == 1
+	}
+	return false
+}
+
+// mfaRequiredForAdmin makes the admin role count only for sessions started
+// with a second factor (MFA_REQUIRED_FOR_ADMIN=true). Admins can still log in
+// with a password alone, e.g. to enroll.
+func mfaRequiredForAdmin() bool {
+	return getEnv("MFA_REQUIRED_FOR_ADMIN", "false") == "true"
+}
+
+// sessionRoles are the roles put in the access token of a session. Without a
+// second factor the admin role is left out when MFA is required for it, so
+// the gateway and every service see a plain user.
+func sessionRoles(roles []string, mfa bool) []string {
+	if mfa || !mfaRequiredForAdmin() {
+		return roles
+	}
+	out := make([]string, 0, len(roles))
+	for _, r := range roles {
+		if r != "admin" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// claimsHaveMFA reports whether the token was issued after a second factor.
+func claimsHaveMFA(claims jwt.MapClaims) bool {
+	amr, _ := claims["amr"].([]interface{})
+	for _, m := range amr {
+		if m == amrOTP {
+			return true
+		}
+	}
+	return false
+}
+
+type mfaLoginRequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type mfaDisableRequest struct {
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// mfaChallenge answers a password login of a user with MFA enabled; the
+// token is exchanged for real tokens at /login/mfa.
+func mfaChallenge(c *gin.Context, db *gorm.DB, u User) {
+	ttl := envDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+	token, err := issueActionToken(db, u.ID, purposeMFAChallenge, ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "token_error", "message": "cannot generate token"}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"mfa_required": true, "mfa_token": token, "expires_in": int(ttl.Seconds())}})
+}
+
+func registerMFAHandlers(users *gin.RouterGroup, db *gorm.DB) {
+	// the challenge is single use and a wrong code counts as a failed login,
+	// so guessing codes is throttled and locked out like guessing passwords
+	users.POST("/login/mfa", func(c *gin.Context) {
+		var req mfaLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		at, err := consumeActionToken(db, req.MFAToken, purposeMFAChallenge)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "invalid_mfa_token", "message": "invalid or expired MFA token"}})
+			return
+		}
+		var u User
+		if err := db.Where("id = ?", at.UserID).First(&u).Error; err != nil || u.MFAEnabledAt == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "invalid_mfa_token", "message": "invalid or expired MFA token"}})
+			return
+		}
+		if u.DisabledAt != nil {
+			accountDisabled(c)
+			return
+		}
+		policy := loginPolicyFromEnv()
+		if wait := logins.check(db, policy, c.ClientIP(), u.Email); wait > 0 {
+			tooManyAttempts(c, wait)
+			return
+		}
+		if !useSecondFactor(db, u, req.Code, req.RecoveryCode) {
+			if err := logins.fail(db, policy, c.ClientIP(), u.Email); err != nil {
+				log.Error().Err(err).Msg("login_throttle_failed")
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "invalid_mfa_code", "message": "invalid code"}})
+			return
+		}
+		if err := logins.reset(db, u.Email); err != nil {
+			log.Error().Err(err).Msg("login_throttle_failed")
+		}
+		tokens, err := issueTokens(db, u, uuid.New(), true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "token_error", "message": "cannot generate token"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": tokens})
+	})
+
+	// enrollment stores a pending secret; MFA is only on once a code from
+	// it has been confirmed
+	users.POST("/me/mfa/totp", AuthMiddleware(db, false), func(c *gin.Context) {
+		var u User
+		if err := db.Where("id = ?", c.GetString("user_id")).First(&u).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+			return
+		}
+		if u.MFAEnabledAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "mfa_already_enabled", "message": "two-factor authentication is already enabled"}})
+			return
+		}
+		secret, err := newTOTPSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "mfa_error", "message": "cannot generate secret"}})
+			return
+		}
+		if err := db.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot save secret"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"secret": secret, "otpauth_uri": totpURI(secret, u.Email)}})
+	})
+
+	users.POST("/me/mfa/totp/confirm", AuthMiddleware(db, false), func(c *gin.Context) {
+		var req mfaCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		var u User
+		if err := db.Where("id = ?", c.GetString("user_id")).First(&u).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+			return
+		}
+		if u.MFAEnabledAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "mfa_already_enabled", "message": "two-factor authentication is already enabled"}})
+			return
+		}
+		if u.TOTPSecret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "mfa_not_enrolled", "message": "start enrollment first"}})
+			return
+		}
+		step, ok := verifyTOTP(u.TOTPSecret, req.Code, 0, time.Now())
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_mfa_code", "message": "invalid code"}})
+			return
+		}
+		var codes []string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{"mfa_enabled_at": time.Now(), "totp_last_step": step}).Error; err != nil {
+				return err
+			}
+			var err error
+			if codes, err = replaceRecoveryCodes(tx, u.ID); err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditMFAEnabled, "")
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot enable two-factor authentication"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"recovery_codes": codes}})
+	})
+
+	users.DELETE("/me/mfa", AuthMiddleware(db, false), func(c *gin.Context) {
+		var req mfaDisableRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		var u User
+		if err := db.Where("id = ?", c.GetString("user_id")).First(&u).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+			return
+		}
+		// wrong passwords and codes count as failed logins, as at /login/mfa
+		policy := loginPolicyFromEnv()
+		if wait := logins.check(db, policy, c.ClientIP(), u.Email); wait > 0 {
+			tooManyAttempts(c, wait)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)) != nil {
+			if err := logins.fail(db, policy, c.ClientIP(), u.Email); err != nil {
+				log.Error().Err(err).Msg("login_throttle_failed")
+			}
+			c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "invalid_credentials", "message": "password is incorrect"}})
+			return
+		}
+		// a stolen session plus the password must not be enough to turn it off
+		if u.MFAEnabledAt != nil && !useSecondFactor(db, u, req.Code, req.RecoveryCode) {
+			if err := logins.fail(db, policy, c.ClientIP(), u.Email); err != nil {
+				log.Error().Err(err).Msg("login_throttle_failed")
+			}
+			c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "invalid_mfa_code", "message": "invalid code"}})
+			return
+		}
+		if err := logins.reset(db, u.Email); err != nil {
+			log.Error().Err(err).Msg("login_throttle_failed")
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{"mfa_enabled_at": nil, "totp_secret": "", "totp_last_step": 0}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error; err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditMFADisabled, "")
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot disable two-factor authentication"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,8 +13,6 @@ import (
 	"gorm.io/gorm"
 )
 
-var jwtSecret = []byte(getEnv("JWT_SECRET", "dev-secret"))
-
 func getEnv(key, def string) string {
 	v := os.Getenv(key)
 	if v == "" {
@@ -24,50 +21,44 @@ func getEnv(key, def string) string {
 	return v
 }
 
-func GenerateJWT(userID string, roles []string) (string, error) {
+// GenerateJWT signs a short lived access token for the session sid; amr lists
+// how the user authenticated.
+func GenerateJWT(userID string, roles []string, sid string, amr []string) (string, error) {
+	now := time.Now()
 	claims := jwt.MapClaims{
 		"sub":   userID,
 		"roles": roles,
-		"exp":   time.Now().Add(24 * time.Hour).Unix(),
+		"sid":   sid,
+		"amr":   amr,
+		"jti":   uuid.New().String(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(accessTokenTTL()).Unix(),
+	}
+	ring, err := signingKeys()
+	if err != nil {
+		return "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return ring.sign(claims)
 }
 
-// AuthMiddleware verifies JWT and sets user context. If adminOnly==true, requires role 'admin'
+// AuthMiddleware identifies the caller (see authMode) and sets user context. If adminOnly==true, requires role 'admin'
 func AuthMiddleware(db *gorm.DB, adminOnly bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		auth := c.GetHeader("Authorization")
-		if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "missing token"}})
+		sub, roles, claims, err := requestIdentity(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": err.Error()}})
 			return
 		}
-		tokenStr := strings.TrimPrefix(auth, "Bearer ")
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-			if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-				return nil, jwt.ErrTokenUnverifiable
-			}
-			return jwtSecret, nil
-		})
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "invalid token"}})
+		// behind the gateway revoked tokens never get this far
+		if claims != nil && tokenRevoked(db, claims) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "token revoked"}})
 			return
 		}
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "invalid token claims"}})
+		if userDisabled(db, sub) {
+			c.Abort()
+			accountDisabled(c)
 			return
 		}
-		sub, _ := claims["sub"].(string)
-		rolesIface := claims["roles"]
-		var roles []string
-		if rolesSlice, ok := rolesIface.([]interface{}); ok {
-			for _, r := range rolesSlice {
-				if s, ok := r.(string); ok {
-					roles = append(roles, s)
-				}
-			}
-		}
 		if adminOnly {
 			found := false
 			for _, r := range roles {
@@ -80,6 +71,16 @@ func AuthMiddleware(db *gorm.DB, adminOnly bool) gin.HandlerFunc {
 				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "forbidden", "message": "admin role required"}})
 				return
 			}
+			if mfaRequiredForAdmin() {
+				// gateway identity headers do not carry amr, so look at the token
+				if claims == nil {
+					claims, _ = bearerClaims(c)
+				}
+				if claims == nil || !claimsHaveMFA(claims) {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "mfa_required", "message": "admin access requires two-factor authentication"}})
+					return
+				}
+			}
 		}
 		c.Set("user_id", sub)
 		c.Set("roles", roles)
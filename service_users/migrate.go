@@ -3,5 +3,14 @@ package main
 import "gorm.io/gorm"
 
 func migrate(db *gorm.DB) error {
-	return db.AutoMigrate(&User{})
+	// users that existed before email verification was introduced are
+	// treated as verified
+	backfillVerified := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "EmailVerifiedAt")
+	if err := db.AutoMigrate(&User{}, &RefreshToken{}, &Revocation{}, &ActionToken{}, &AuditEvent{}, &RecoveryCode{}, &LoginThrottle{}); err != nil {
+		return err
+	}
+	if backfillVerified {
+		return db.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL").Error
+	}
+	return nil
 }
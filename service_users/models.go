@@ -11,13 +11,72 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID     `gorm:"type:uuid;primaryKey" json:"id"`
-	Email     string        `gorm:"uniqueIndex;not null" json:"email"`
-	Password  string        `gorm:"not null" json:"-"`
-	Name      string        `json:"name"`
-	Roles     pqStringArray `gorm:"type:text[];default:'{user}'" json:"roles"`
-	CreatedAt time.Time     `json:"created_at"`
-	UpdatedAt time.Time     `json:"updated_at"`
+	ID       uuid.UUID     `gorm:"type:uuid;primaryKey" json:"id"`
+	Email    string        `gorm:"uniqueIndex;not null" json:"email"`
+	Password string        `gorm:"not null" json:"-"`
+	Name     string        `json:"name"`
+	Roles    pqStringArray `gorm:"type:text[];default:'{user}'" json:"roles"`
+	// profile fields the user edits with PUT /me
+	Phone     string `json:"phone"`
+	Locale    string `json:"locale"`
+	AvatarURL string `json:"avatar_url"`
+	// PendingEmail is the address asked for with POST /me/email until its
+	// owner confirms it.
+	PendingEmail string `json:"pending_email,omitempty"`
+	// DisabledAt is set while an admin has disabled the account.
+	DisabledAt *time.Time `json:"disabled_at"`
+	// EmailVerifiedAt is nil until the user follows the link from the
+	// verification email.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// TOTPSecret is set by MFA enrollment and only in use once MFAEnabledAt
+	// is; TOTPLastStep is the last time step accepted, to refuse replays.
+	TOTPSecret   string     `json:"-"`
+	TOTPLastStep int64      `gorm:"not null;default:0" json:"-"`
+	MFAEnabledAt *time.Time `json:"mfa_enabled_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// RefreshToken is one opaque refresh token, stored as a sha256 hash. Tokens
+// issued by one login and its refreshes share a FamilyID.
+type RefreshToken struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index;not null" json:"user_id"`
+	FamilyID  uuid.UUID  `gorm:"type:uuid;index;not null" json:"family_id"`
+	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	// MFA is set when the session was started with a second factor, so that
+	// refreshed access tokens keep saying so.
+	MFA       bool      `gorm:"not null;default:false" json:"mfa"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (t *RefreshToken) BeforeCreate(tx *gorm.DB) (err error) {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
+// ActionToken is a single use, expiring token sent to the user by email, e.g.
+// for a password reset. Only its sha256 hash is stored.
+type ActionToken struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;index;not null" json:"user_id"`
+	Purpose   string     `gorm:"index;not null" json:"purpose"`
+	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (t *ActionToken) BeforeCreate(tx *gorm.DB) (err error) {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
 }
 
 // pqStringArray is a helper type for postgres text[] via simple parsing
@@ -51,18 +110,24 @@ func (a *pqStringArray) Scan(value interface{}) error {
 	return nil
 }
 
+func (a pqStringArray) Value() (driver.Value, error) {
+	return valueStringArray(a)
+}
+
 func valueStringArray(arr []string) (driver.Value, error) {
 	if arr == nil || len(arr) == 0 {
 		return "{}", nil
 	}
 	// join with commas and wrap
+	out := make([]string, len(arr))
 	for i := range arr {
+		out[i] = arr[i]
 		if strings.ContainsAny(arr[i], ",{}\" ") {
 			// naive escaping
-			arr[i] = `"` + strings.ReplaceAll(arr[i], `"`, `\"`) + `"`
+			out[i] = `"` + strings.ReplaceAll(arr[i], `"`, `\"`) + `"`
 		}
 	}
-	return "{" + strings.Join(arr, ",") + "}", nil
+	return "{" + strings.Join(out, ",") + "}", nil
 }
 
 func (u *User) BeforeCreate(tx *gorm.DB) (err error) {
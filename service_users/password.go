@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Action token purposes.
+const purposePasswordReset = "password_reset"
+
+var errActionTokenInvalid = errors.New("invalid or expired token")
+
+// checkPasswordPolicy is applied wherever a password is set. bcrypt ignores
+// everything after 72 bytes, so longer passwords are refused rather than
+// silently truncated.
+func checkPasswordPolicy(pw string) error {
+	if len(pw) < 6 {
+		return errors.New("password must be at least 6 characters")
+	}
+	if len(pw) > 72 {
+		return errors.New("password must be at most 72 bytes")
+	}
+	return nil
+}
+
+// issueActionToken creates a token for purpose and retires any earlier
+// unused one, so only the latest email link works.
+func issueActionToken(tx *gorm.DB, uid uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if err := tx.Model(&ActionToken{}).Where("user_id = ? AND purpose = ? AND used_at IS NULL", uid, purpose).Update("used_at", now).Error; err != nil {
+		return "", err
+	}
+	at := ActionToken{UserID: uid, Purpose: purpose, TokenHash: hashToken(token), ExpiresAt: now.Add(ttl)}
+	if err := tx.Create(&at).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeActionToken spends token, which must match purpose and be unused
+// and unexpired.
+func consumeActionToken(tx *gorm.DB, token, purpose string) (ActionToken, error) {
+	var at ActionToken
+	if err := tx.Where("token_hash = ? AND purpose = ?", hashToken(token), purpose).First(&at).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return at, errActionTokenInvalid
+		}
+		return at, err
+	}
+	if at.UsedAt != nil || time.Now().After(at.ExpiresAt) {
+		return at, errActionTokenInvalid
+	}
+	res := tx.Model(&ActionToken{}).Where("id = ? AND used_at IS NULL", at.ID).Update("used_at", time.Now())
+	if res.Error != nil {
+		return at, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return at, errActionTokenInvalid
+	}
+	return at, nil
+}
+
+// actionLink builds the link put in emails; APP_BASE_URL is the frontend.
+func actionLink(path, token string) string {
+	return strings.TrimSuffix(getEnv("APP_BASE_URL", "http://localhost:3000"), "/") + path + "?token=" + token
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// Password reset requests are limited per email and per client IP on this
+// instance, over PASSWORD_RESET_INTERVAL. The limits key on what the caller
+// sent, so registered and unknown emails are limited alike.
+
+type requestWindow struct {
+	start time.Time
+	count int
+}
+
+// requestLimiter counts requests per key in fixed windows.
+type requestLimiter struct {
+	mu   sync.Mutex
+	hits map[string]*requestWindow
+}
+
+var resetRequests = &requestLimiter{hits: map[string]*requestWindow{}}
+
+// allow counts a request for key and returns how long the caller has to wait
+// if it is over max in the current window, or zero.
+func (l *requestLimiter) allow(key string, max int, window time.Duration, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.hits[key]
+	if !ok || now.Sub(w.start) >= window {
+		w = &requestWindow{start: now}
+		l.hits[key] = w
+	}
+	if w.count >= max {
+		return window - now.Sub(w.start)
+	}
+	w.count++
+	if len(l.hits) > 10000 {
+		for k, w := range l.hits {
+			if now.Sub(w.start) >= window {
+				delete(l.hits, k)
+			}
+		}
+	}
+	return 0
+}
+
+func passwordResetInterval() time.Duration {
+	return envDuration("PASSWORD_RESET_INTERVAL", time.Minute)
+}
+
+// resetJobs feeds a fixed pool of workers so a flood of requests cannot start
+// unbounded goroutines and database writes. A full queue drops the request,
+// the same way for every email.
+var (
+	resetJobs        = make(chan func(), 256)
+	startResetWorker sync.Once
+)
+
+func startResetWorkers() {
+	startResetWorker.Do(func() {
+		for i := 0; i < 4; i++ {
+			go func() {
+				for job := range resetJobs {
+					job()
+				}
+			}()
+		}
+	})
+}
+
+// sendPasswordReset mails a reset link if email belongs to an account. It
+// runs in the background: the token is only written for registered emails
+// and the extra time would otherwise show in the response. While a link sent
+// within PASSWORD_RESET_INTERVAL is still valid no new one is issued.
+func sendPasswordReset(db *gorm.DB, email string) {
+	var u User
+	if err := db.Where("email = ?", email).First(&u).Error; err != nil {
+		return
+	}
+	now := time.Now()
+	var recent int64
+	if err := db.Model(&ActionToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ? AND created_at > ?", u.ID, purposePasswordReset, now, now.Add(-passwordResetInterval())).
+		Count(&recent).Error; err != nil || recent > 0 {
+		return
+	}
+	ttl := envDuration("PASSWORD_RESET_TTL", time.Hour)
+	token, err := issueActionToken(db, u.ID, purposePasswordReset, ttl)
+	if err != nil {
+		log.Error().Err(err).Msg("password_reset_token_failed")
+		return
+	}
+	sendAsync(Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for this account.\n\nOpen %s within %s to choose a new one. If it was not you, ignore this email.\n",
+			actionLink("/reset-password", token), ttl),
+	})
+}
+
+func registerPasswordHandlers(users *gin.RouterGroup, db *gorm.DB) {
+	startResetWorkers()
+
+	// forgot answers the same way, and as fast, for registered and unknown
+	// emails, limits included, so it cannot be used to probe which exist
+	users.POST("/password/forgot", func(c *gin.Context) {
+		var req forgotPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		email := strings.ToLower(req.Email)
+		interval := passwordResetInterval()
+		now := time.Now()
+		wait := resetRequests.allow("ip:"+c.ClientIP(), envInt("PASSWORD_RESET_IP_MAX", 10), interval, now)
+		if wait == 0 {
+			wait = resetRequests.allow("email:"+email, 1, interval, now)
+		}
+		if wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "error": gin.H{"code": "too_many_requests", "message": "a password reset was requested recently"}})
+			return
+		}
+		select {
+		case resetJobs <- func() { sendPasswordReset(db, email) }:
+		default:
+			log.Warn().Msg("password_reset_queue_full")
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "if the email is registered, a reset link has been sent"})
+	})
+
+	users.POST("/password/reset", func(c *gin.Context) {
+		var req resetPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		if err := checkPasswordPolicy(req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "weak_password", "message": err.Error()}})
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "hash_error", "message": "cannot hash password"}})
+			return
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			at, err := consumeActionToken(tx, req.Token, purposePasswordReset)
+			if err != nil {
+				return err
+			}
+			var u User
+			if err := tx.Where("id = ?", at.UserID).First(&u).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Update("password", string(hash)).Error; err != nil {
+				return err
+			}
+			// the reset proves who owns the account, so lift any lockout
+			if err := logins.reset(tx, u.Email); err != nil {
+				return err
+			}
+			// whoever knew the old password must not stay logged in
+			_, err = revokeUserSessions(tx, u.ID)
+			return err
+		})
+		if errors.Is(err, errActionTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_token", "message": err.Error()}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot reset password"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	// changing the password keeps the caller's own session and ends all others
+	users.PUT("/me/password", AuthMiddleware(db, false), func(c *gin.Context) {
+		var req changePasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		var u User
+		if err := db.Where("id = ?", c.GetString("user_id")).First(&u).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.CurrentPassword)) != nil {
+			c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "invalid_credentials", "message": "current password is incorrect"}})
+			return
+		}
+		if err := checkPasswordPolicy(req.NewPassword); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "weak_password", "message": err.Error()}})
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "hash_error", "message": "cannot hash password"}})
+			return
+		}
+		// the session is only known from a bearer token; without one every
+		// session is ended
+		var keep uuid.UUID
+		if claims, err := bearerClaims(c); err == nil {
+			sid, _ := claims["sid"].(string)
+			keep, _ = uuid.Parse(sid)
+		}
+		var n int
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Update("password", string(hash)).Error; err != nil {
+				return err
+			}
+			if n, err = revokeOtherSessions(tx, u.ID, keep); err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditPasswordChanged, "")
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot change password"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"revoked_sessions": n}})
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const purposeEmailChange = "email_change"
+
+var errEmailTaken = errors.New("email already registered")
+
+// updateProfileRequest lists everything a user may change about themselves
+// with PUT /me. Absent fields are left alone; phone, locale and avatar_url
+// are cleared with an empty string (the max=0 alternative).
+type updateProfileRequest struct {
+	Name      *string `json:"name" binding:"omitnil,min=1,max=100"`
+	Phone     *string `json:"phone" binding:"omitnil,max=0|e164"`
+	Locale    *string `json:"locale" binding:"omitnil,max=0|bcp47_language_tag"`
+	AvatarURL *string `json:"avatar_url" binding:"omitnil,max=2048,max=0|http_url"`
+}
+
+// updates returns the columns to write.
+func (r updateProfileRequest) updates() map[string]interface{} {
+	out := map[string]interface{}{}
+	if r.Name != nil {
+		out["name"] = *r.Name
+	}
+	if r.Phone != nil {
+		out["phone"] = *r.Phone
+	}
+	if r.Locale != nil {
+		out["locale"] = *r.Locale
+	}
+	if r.AvatarURL != nil {
+		out["avatar_url"] = *r.AvatarURL
+	}
+	return out
+}
+
+type changeEmailRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+// bindStrict is ShouldBindJSON that also refuses fields obj does not have,
+// so a typo or a field the caller may not set is an error rather than
+// silently ignored.
+func bindStrict(c *gin.Context, obj interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(obj); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("request body is empty")
+		}
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the JSON object")
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
+
+func registerProfileHandlers(users *gin.RouterGroup, db *gorm.DB) {
+	// the new address only replaces the old one once its owner follows the
+	// link sent to it
+	users.POST("/me/email", AuthMiddleware(db, false), func(c *gin.Context) {
+		var req changeEmailRequest
+		if err := bindStrict(c, &req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		email := strings.ToLower(req.Email)
+		var u User
+		if err := db.Where("id = ?", c.GetString("user_id")).First(&u).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(req.Password)) != nil {
+			c.JSON(http.StatusForbidden, gin.H{"success": false, "error": gin.H{"code": "invalid_credentials", "message": "password is incorrect"}})
+			return
+		}
+		var taken int64
+		db.Model(&User{}).Where("email = ?", email).Count(&taken)
+		if taken > 0 {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "email_exists", "message": "Email already registered"}})
+			return
+		}
+		ttl := envDuration("EMAIL_VERIFY_TTL", 48*time.Hour)
+		var token string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Update("pending_email", email).Error; err != nil {
+				return err
+			}
+			var err error
+			token, err = issueActionToken(tx, u.ID, purposeEmailChange, ttl)
+			return err
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot change email"}})
+			return
+		}
+		sendAsync(Message{
+			To:      email,
+			Subject: "Confirm your new email",
+			Body:    fmt.Sprintf("Open %s within %s to make this the email address of your account.\n", actionLink("/confirm-email", token), ttl),
+		})
+		c.JSON(http.StatusAccepted, gin.H{"success": true, "message": "a confirmation link has been sent to the new address"})
+	})
+
+	// public: the token from the email is the proof
+	users.POST("/email/confirm", func(c *gin.Context) {
+		var req verifyEmailRequest
+		if err := bindStrict(c, &req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		var u User
+		err := db.Transaction(func(tx *gorm.DB) error {
+			at, err := consumeActionToken(tx, req.Token, purposeEmailChange)
+			if err != nil {
+				return err
+			}
+			if err := tx.Where("id = ?", at.UserID).First(&u).Error; err != nil {
+				return err
+			}
+			if u.PendingEmail == "" {
+				return errActionTokenInvalid
+			}
+			var taken int64
+			if err := tx.Model(&User{}).Where("email = ?", u.PendingEmail).Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return errEmailTaken
+			}
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+				"email":             u.PendingEmail,
+				"pending_email":     "",
+				"email_verified_at": time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditEmailChanged, "")
+		})
+		switch {
+		case errors.Is(err, errActionTokenInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_token", "message": errActionTokenInvalid.Error()}})
+			return
+		case errors.Is(err, errEmailTaken):
+			c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "email_exists", "message": "Email already registered"}})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot change email"}})
+			return
+		}
+		// tell the old address, in case the change was not its owner's doing
+		sendAsync(Message{
+			To:      u.Email,
+			Subject: "Your email was changed",
+			Body:    fmt.Sprintf("The email address of your account was changed to %s. If it was not you, reset your password and contact support.\n", u.PendingEmail),
+		})
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// Revocation kinds. A jti revokes one access token, a sid every access token
+// of a login session.
+const (
+	revokeJTI = "jti"
+	revokeSID = "sid"
+)
+
+// Revocation is a denylist entry. Entries are only needed until every token
+// they match has expired, after which they are pruned.
+type Revocation struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"-"`
+	Kind      string    `gorm:"index:idx_revocation_value;not null" json:"kind"`
+	Value     string    `gorm:"index:idx_revocation_value;not null" json:"value"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt time.Time `json:"-"`
+}
+
+func (r *Revocation) BeforeCreate(tx *gorm.DB) (err error) {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// revokeSessions ends the given login sessions: their refresh tokens stop
+// working and access tokens already issued for them are denylisted until they
+// would have expired anyway. Expired entries are pruned on every write so the
+// list the gateway syncs stays short.
+func revokeSessions(tx *gorm.DB, families []uuid.UUID) error {
+	until := time.Now().Add(accessTokenTTL())
+	for _, f := range families {
+		if err := revokeFamily(tx, f); err != nil {
+			return err
+		}
+		if err := tx.Create(&Revocation{Kind: revokeSID, Value: f.String(), ExpiresAt: until}).Error; err != nil {
+			return err
+		}
+	}
+	return pruneRevocations(tx)
+}
+
+// revokeUserSessions ends every live session of uid and returns how many
+// there were.
+func revokeUserSessions(tx *gorm.DB, uid uuid.UUID) (int, error) {
+	return revokeOtherSessions(tx, uid, uuid.Nil)
+}
+
+// revokeOtherSessions ends every live session of uid except keep.
+func revokeOtherSessions(tx *gorm.DB, uid, keep uuid.UUID) (int, error) {
+	var families []uuid.UUID
+	if err := tx.Model(&RefreshToken{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL AND expires_at > ?", uid, keep, time.Now()).
+		Distinct().Pluck("family_id", &families).Error; err != nil {
+		return 0, err
+	}
+	return len(families), revokeSessions(tx, families)
+}
+
+// tokenRevoked reports whether claims match a denylist entry.
+func tokenRevoked(db *gorm.DB, claims jwt.MapClaims) bool {
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+	var n int64
+	db.Model(&Revocation{}).
+		Where("expires_at > ?", time.Now()).
+		Where("(kind = ? AND value = ?) OR (kind = ? AND value = ?)", revokeJTI, jti, revokeSID, sid).
+		Count(&n)
+	return n > 0
+}
+
+func pruneRevocations(tx *gorm.DB) error {
+	return tx.Where("expires_at <= ?", time.Now()).Delete(&Revocation{}).Error
+}
+
+// internalOnly admits requests carrying INTERNAL_AUTH_KEY in X-Internal-Key.
+func internalOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := getEnv("INTERNAL_AUTH_KEY", "")
+		if key == "" || !hmac.Equal([]byte(c.GetHeader("X-Internal-Key")), []byte(key)) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "internal key required"}})
+			return
+		}
+		c.Next()
+	}
+}
+
+func registerRevocationHandlers(r *gin.Engine, users *gin.RouterGroup, db *gorm.DB) {
+	// logout ends the caller's session; the access token is parsed again
+	// because the gateway identity headers carry neither jti nor sid
+	users.POST("/logout", AuthMiddleware(db, false), func(c *gin.Context) {
+		claims, err := bearerClaims(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": err.Error()}})
+			return
+		}
+		jti, _ := claims["jti"].(string)
+		sid, _ := claims["sid"].(string)
+		exp, _ := claims.GetExpirationTime()
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if jti != "" && exp != nil {
+				if err := tx.Create(&Revocation{Kind: revokeJTI, Value: jti, ExpiresAt: exp.Time}).Error; err != nil {
+					return err
+				}
+			}
+			if family, err := uuid.Parse(sid); err == nil {
+				return revokeSessions(tx, []uuid.UUID{family})
+			}
+			return pruneRevocations(tx)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot revoke token"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	users.POST("/:id/sessions/revoke", AuthMiddleware(db, true), func(c *gin.Context) {
+		uid, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_id", "message": "invalid user id"}})
+			return
+		}
+		var n int
+		err = db.Transaction(func(tx *gorm.DB) error {
+			n, err = revokeUserSessions(tx, uid)
+			return err
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot revoke sessions"}})
+			return
+		}
+		log.Info().Str("user_id", uid.String()).Str("by", c.GetString("user_id")).Int("sessions", n).Msg("sessions_revoked")
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": gin.H{"revoked_sessions": n}})
+	})
+
+	// the gateway polls this to keep its denylist in sync
+	r.GET("/internal/revocations", internalOnly(), func(c *gin.Context) {
+		var list []Revocation
+		if err := db.Where("expires_at > ?", time.Now()).Find(&list).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "DB error"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": list})
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Failed logins are counted per email address (in the database, so every
+// instance agrees) and per client IP (in memory). Each failure for an email
+// makes its next attempt wait twice as long as the one before; after too
+// many failures the email or IP is locked out. IPs get no delay so one typo
+// does not slow down everyone behind the same NAT. Unknown emails are
+// counted the same way, so the answers do not reveal which accounts exist.
+
+// LoginThrottle holds the failed login state of one email address.
+type LoginThrottle struct {
+	Email         string     `gorm:"primaryKey" json:"email"`
+	Failures      int        `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+type loginPolicy struct {
+	maxFailures   int           // per email before a lockout
+	maxIPFailures int           // per IP before a lockout
+	lockout       time.Duration // lockout length; also when failures are forgotten
+	delay         time.Duration // wait after the first failure, doubled after each
+}
+
+func loginPolicyFromEnv() loginPolicy {
+	return loginPolicy{
+		maxFailures:   envInt("LOGIN_MAX_FAILURES", 5),
+		maxIPFailures: envInt("LOGIN_IP_MAX_FAILURES", 20),
+		lockout:       envDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		delay:         envDuration("LOGIN_DELAY", time.Second),
+	}
+}
+
+func envInt(key string, def int) int {
+	n, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// retryAfter is how long a key with this failure history has to wait before
+// its next attempt.
+func (p loginPolicy) retryAfter(failures int, last time.Time, lockedUntil *time.Time, now time.Time) time.Duration {
+	if lockedUntil != nil && now.Before(*lockedUntil) {
+		return lockedUntil.Sub(now)
+	}
+	if failures == 0 || now.Sub(last) >= p.lockout {
+		return 0
+	}
+	d := p.delay
+	for i := 1; i < failures && d < p.lockout; i++ {
+		d *= 2
+	}
+	if d > p.lockout {
+		d = p.lockout
+	}
+	return d - now.Sub(last)
+}
+
+// forgotten reports whether earlier failures no longer count.
+func (p loginPolicy) forgotten(last time.Time, lockedUntil *time.Time, now time.Time) bool {
+	if lockedUntil != nil {
+		return !now.Before(*lockedUntil)
+	}
+	return now.Sub(last) >= p.lockout
+}
+
+type ipAttempts struct {
+	failures    int
+	last        time.Time
+	lockedUntil *time.Time
+}
+
+// loginThrottle tracks failures per IP for this instance.
+type loginThrottle struct {
+	mu  sync.Mutex
+	ips map[string]*ipAttempts
+}
+
+var logins = &loginThrottle{ips: map[string]*ipAttempts{}}
+
+// check returns how long the caller has to wait before trying to log in as
+// email from ip, or zero if they may try now.
+func (t *loginThrottle) check(db *gorm.DB, p loginPolicy, ip, email string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	t.mu.Lock()
+	if a, ok := t.ips[ip]; ok && a.lockedUntil != nil && now.Before(*a.lockedUntil) {
+		wait = a.lockedUntil.Sub(now)
+	}
+	t.mu.Unlock()
+	var lt LoginThrottle
+	if err := db.Where("email = ?", email).Limit(1).Find(&lt).Error; err == nil && lt.Email != "" {
+		if w := p.retryAfter(lt.Failures, lt.LastFailureAt, lt.LockedUntil, now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// fail records a failed login as email from ip.
+func (t *loginThrottle) fail(db *gorm.DB, p loginPolicy, ip, email string) error {
+	now := time.Now()
+	t.mu.Lock()
+	a, ok := t.ips[ip]
+	if !ok || p.forgotten(a.last, a.lockedUntil, now) {
+		a = &ipAttempts{}
+		t.ips[ip] = a
+	}
+	a.failures++
+	a.last = now
+	if a.failures >= p.maxIPFailures {
+		until := now.Add(p.lockout)
+		a.lockedUntil = &until
+	}
+	if len(t.ips) > 10000 {
+		t.sweep(p, now)
+	}
+	t.mu.Unlock()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var lt LoginThrottle
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("email = ?", email).Limit(1).Find(&lt).Error; err != nil {
+			return err
+		}
+		if lt.Email == "" || p.forgotten(lt.LastFailureAt, lt.LockedUntil, now) {
+			lt = LoginThrottle{Email: email}
+		}
+		lt.Failures++
+		lt.LastFailureAt = now
+		if lt.Failures >= p.maxFailures {
+			until := now.Add(p.lockout)
+			lt.LockedUntil = &until
+		}
+		return tx.Save(&lt).Error
+	})
+}
+
+// reset forgets the failures of email, after a successful login or an admin
+// unlock. IP failures are kept: one valid password must not reset the count
+// of an IP trying many accounts.
+func (t *loginThrottle) reset(db *gorm.DB, email string) error {
+	return db.Where("email = ?", email).Delete(&LoginThrottle{}).Error
+}
+
+func (t *loginThrottle) sweep(p loginPolicy, now time.Time) {
+	for ip, a := range t.ips {
+		if p.forgotten(a.last, a.lockedUntil, now) {
+			delete(t.ips, ip)
+		}
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyPassword spends the same time as checking a real password, for
+// emails that have no account.
+func compareDummyPassword(pw string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(pw))
+}
+
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "error": gin.H{"code": "too_many_attempts", "message": "too many failed login attempts, try again later"}})
+}
+
+func registerThrottleHandlers(users *gin.RouterGroup, db *gorm.DB) {
+	users.POST("/:id/unlock", AuthMiddleware(db, true), func(c *gin.Context) {
+		uid, err := uuid.Parse(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_id", "message": "invalid user id"}})
+			return
+		}
+		var u User
+		if err := db.Where("id = ?", uid).First(&u).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+			return
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := logins.reset(tx, u.Email); err != nil {
+				return err
+			}
+			return recordAudit(tx, c, u.ID, auditAccountUnlocked, "")
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot unlock account"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+var (
+	errRefreshInvalid = errors.New("invalid refresh token")
+	errRefreshReused  = errors.New("refresh token reuse detected")
+)
+
+func accessTokenTTL() time.Duration {
+	return envDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+func refreshTokenTTL() time.Duration {
+	return envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// hashToken is how opaque tokens are stored; the plain value only ever
+// exists in the response to the client.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueTokens creates an access token and a refresh token in family. A login
+// starts a new family; every refresh continues it, so the family id doubles
+// as the session id carried in the access token's sid claim. mfa records
+// that the session was started with a second factor.
+func issueTokens(tx *gorm.DB, u User, family uuid.UUID, mfa bool) (gin.H, error) {
+	refresh, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	rt := RefreshToken{UserID: u.ID, FamilyID: family, TokenHash: hashToken(refresh), ExpiresAt: time.Now().Add(refreshTokenTTL()), MFA: mfa}
+	if err := tx.Create(&rt).Error; err != nil {
+		return nil, err
+	}
+	amr := []string{amrPassword}
+	if mfa {
+		amr = append(amr, amrOTP)
+	}
+	access, err := GenerateJWT(u.ID.String(), sessionRoles(u.Roles, mfa), family.String(), amr)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":         access,
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(accessTokenTTL().Seconds()),
+		"refresh_token": refresh,
+	}, nil
+}
+
+// rotateRefreshToken spends a refresh token and issues its successor. A token
+// that was already spent means it leaked (or the client raced itself), so the
+// whole session is revoked, access tokens included, and the user has to log
+// in again.
+func rotateRefreshToken(db *gorm.DB, token string) (gin.H, error) {
+	var out gin.H
+	var reusedFamily uuid.UUID
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var rt RefreshToken
+		if err := tx.Where("token_hash = ?", hashToken(token)).First(&rt).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errRefreshInvalid
+			}
+			return err
+		}
+		if rt.RevokedAt != nil || time.Now().After(rt.ExpiresAt) {
+			return errRefreshInvalid
+		}
+		now := time.Now()
+		// the used_at guard makes concurrent refreshes of one token race safely
+		res := tx.Model(&RefreshToken{}).Where("id = ? AND used_at IS NULL", rt.ID).Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			reusedFamily = rt.FamilyID
+			return errRefreshReused
+		}
+		var u User
+		if err := tx.Where("id = ?", rt.UserID).First(&u).Error; err != nil || u.DisabledAt != nil {
+			return errRefreshInvalid
+		}
+		var err error
+		out, err = issueTokens(tx, u, rt.FamilyID, rt.MFA)
+		return err
+	})
+	if errors.Is(err, errRefreshReused) {
+		// the denylist entry also ends access tokens already issued in the family
+		if rerr := revokeSessions(db, []uuid.UUID{reusedFamily}); rerr != nil {
+			return nil, rerr
+		}
+		log.Warn().Str("family", reusedFamily.String()).Msg("refresh_token_reused")
+	}
+	return out, err
+}
+
+func revokeFamily(db *gorm.DB, family uuid.UUID) error {
+	return db.Model(&RefreshToken{}).Where("family_id = ? AND revoked_at IS NULL", family).Update("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// sortable columns of the admin user list
+var userSortColumns = map[string]bool{"created_at": true, "email": true, "name": true}
+
+// userListQuery is the parsed query string of GET /v1/users/.
+type userListQuery struct {
+	page, size    int
+	sort          string // column
+	desc          bool
+	cursor        *userCursor
+	role          string
+	emailDomain   string
+	createdAfter  *time.Time
+	createdBefore *time.Time
+	disabled      *bool
+	search        string
+}
+
+// userCursor points just past the last user of a page. It repeats the sort
+// so that a cursor cannot be replayed against a different ordering.
+type userCursor struct {
+	Sort  string    `json:"s"`
+	Desc  bool      `json:"d"`
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+func (cur userCursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(s string) (*userCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cur userCursor
+	if err := json.Unmarshal(b, &cur); err != nil || !userSortColumns[cur.Sort] {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cur, nil
+}
+
+// parseTimeParam accepts RFC 3339 timestamps and plain dates.
+func parseTimeParam(name, v string) (*time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be an RFC 3339 time or a YYYY-MM-DD date", name)
+}
+
+func parseUserListQuery(c *gin.Context) (userListQuery, error) {
+	q := userListQuery{page: 1, size: 20, sort: "created_at", desc: true}
+	// same lenient page/size handling as the orders list
+	if p, err := strconv.Atoi(c.Query("page")); err == nil && p > 0 {
+		q.page = p
+	}
+	if s, err := strconv.Atoi(c.Query("size")); err == nil && s > 0 && s <= 100 {
+		q.size = s
+	}
+	if s := c.Query("sort"); s != "" {
+		q.desc = strings.HasPrefix(s, "-")
+		q.sort = strings.TrimPrefix(s, "-")
+		if !userSortColumns[q.sort] {
+			return q, errors.New("sort must be created_at, email or name, optionally prefixed with -")
+		}
+	}
+	if s := c.Query("cursor"); s != "" {
+		cur, err := decodeUserCursor(s)
+		if err != nil {
+			return q, err
+		}
+		if cur.Sort != q.sort || cur.Desc != q.desc {
+			return q, errors.New("cursor was issued for a different sort")
+		}
+		q.cursor = cur
+	}
+	q.role = c.Query("role")
+	q.emailDomain = strings.ToLower(strings.TrimPrefix(c.Query("email_domain"), "@"))
+	var err error
+	if v := c.Query("created_after"); v != "" {
+		if q.createdAfter, err = parseTimeParam("created_after", v); err != nil {
+			return q, err
+		}
+	}
+	if v := c.Query("created_before"); v != "" {
+		if q.createdBefore, err = parseTimeParam("created_before", v); err != nil {
+			return q, err
+		}
+	}
+	if v := c.Query("disabled"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, errors.New("disabled must be true or false")
+		}
+		q.disabled = &b
+	}
+	q.search = strings.ToLower(strings.TrimSpace(c.Query("q")))
+	return q, nil
+}
+
+// escapeLike makes s match literally inside a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// filter applies everything but sorting and paging.
+func (q userListQuery) filter(db *gorm.DB) *gorm.DB {
+	tx := db.Model(&User{})
+	if q.role != "" {
+		if db.Dialector.Name() == "postgres" {
+			tx = tx.Where("? = ANY(roles)", q.role)
+		} else {
+			// elsewhere roles is stored as text such as {user,admin}
+			tx = tx.Where("',' || trim(roles, '{}') || ',' LIKE ? ESCAPE '\\'", "%,"+escapeLike(q.role)+",%")
+		}
+	}
+	if q.emailDomain != "" {
+		tx = tx.Where("email LIKE ? ESCAPE '\\'", "%@"+escapeLike(q.emailDomain))
+	}
+	if q.createdAfter != nil {
+		tx = tx.Where("created_at >= ?", *q.createdAfter)
+	}
+	if q.createdBefore != nil {
+		tx = tx.Where("created_at < ?", *q.createdBefore)
+	}
+	if q.disabled != nil {
+		if *q.disabled {
+			tx = tx.Where("disabled_at IS NOT NULL")
+		} else {
+			tx = tx.Where("disabled_at IS NULL")
+		}
+	}
+	if q.search != "" {
+		pattern := "%" + escapeLike(q.search) + "%"
+		tx = tx.Where("(LOWER(name) LIKE ? ESCAPE '\\' OR LOWER(email) LIKE ? ESCAPE '\\')", pattern, pattern)
+	}
+	return tx
+}
+
+// sortValue is u's value of the sort column, as stored in a cursor.
+func (q userListQuery) sortValue(u User) string {
+	switch q.sort {
+	case "email":
+		return u.Email
+	case "name":
+		return u.Name
+	}
+	return u.CreatedAt.UTC().Format(time.RFC3339Nano)
+}
+
+// list returns one page of users and the cursor of the next page, if any.
+// The id breaks ties so that keyset paging never skips or repeats users.
+func (q userListQuery) list(db *gorm.DB) ([]User, string, error) {
+	dir, cmp := "ASC", ">"
+	if q.desc {
+		dir, cmp = "DESC", "<"
+	}
+	tx := q.filter(db).Order(q.sort + " " + dir).Order("id " + dir)
+	if q.cursor != nil {
+		var v interface{} = q.cursor.Value
+		if q.sort == "created_at" {
+			t, err := time.Parse(time.RFC3339Nano, q.cursor.Value)
+			if err != nil {
+				return nil, "", errors.New("invalid cursor")
+			}
+			v = t
+		}
+		tx = tx.Where(fmt.Sprintf("(%s %s ?) OR (%s = ? AND id %s ?)", q.sort, cmp, q.sort, cmp), v, v, q.cursor.ID)
+	} else {
+		tx = tx.Offset((q.page - 1) * q.size)
+	}
+	var users []User
+	if err := tx.Limit(q.size + 1).Find(&users).Error; err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(users) > q.size {
+		users = users[:q.size]
+		last := users[len(users)-1]
+		next = userCursor{Sort: q.sort, Desc: q.desc, Value: q.sortValue(last), ID: last.ID}.encode()
+	}
+	return users, next, nil
+}
+
+func listUsers(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, err := parseUserListQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		var total int64
+		if err := q.filter(db).Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "DB error"}})
+			return
+		}
+		users, next, err := q.list(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "DB error"}})
+			return
+		}
+		// the orders list meta, plus next_cursor; page and total_pages only
+		// mean something when paging by page
+		meta := gin.H{"total": total, "size": q.size}
+		if q.cursor == nil {
+			meta["page"] = q.page
+			meta["total_pages"] = int((total + int64(q.size) - 1) / int64(q.size))
+		}
+		if next != "" {
+			meta["next_cursor"] = next
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "data": users, "meta": meta})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const purposeEmailVerify = "email_verify"
+
+type verifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+func emailVerifyTTL() time.Duration {
+	return envDuration("EMAIL_VERIFY_TTL", 48*time.Hour)
+}
+
+// issueVerificationToken issues a fresh verification token for u. Callers
+// mail it with mailVerification once their transaction has committed, so a
+// rolled back change never sends a link that does not exist.
+func issueVerificationToken(tx *gorm.DB, u User) (string, error) {
+	return issueActionToken(tx, u.ID, purposeEmailVerify, emailVerifyTTL())
+}
+
+func mailVerification(u User, token string) {
+	sendAsync(Message{
+		To:      u.Email,
+		Subject: "Confirm your email",
+		Body:    fmt.Sprintf("Welcome, %s!\n\nOpen %s within %s to confirm your email address.\n", u.Name, actionLink("/verify-email", token), emailVerifyTTL()),
+	})
+}
+
+// sendVerificationEmail issues a fresh verification token for u and mails it,
+// for callers outside a transaction.
+func sendVerificationEmail(db *gorm.DB, u User) error {
+	token, err := issueVerificationToken(db, u)
+	if err != nil {
+		return err
+	}
+	mailVerification(u, token)
+	return nil
+}
+
+func registerVerifyHandlers(users *gin.RouterGroup, db *gorm.DB) {
+	users.POST("/verify-email", func(c *gin.Context) {
+		var req verifyEmailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_input", "message": err.Error()}})
+			return
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			at, err := consumeActionToken(tx, req.Token, purposeEmailVerify)
+			if err != nil {
+				return err
+			}
+			return tx.Model(&User{}).Where("id = ? AND email_verified_at IS NULL", at.UserID).Update("email_verified_at", time.Now()).Error
+		})
+		if errors.Is(err, errActionTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": gin.H{"code": "invalid_token", "message": err.Error()}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot verify email"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+
+	// resend is throttled per user to EMAIL_VERIFY_RESEND_INTERVAL
+	users.POST("/verify-email/resend", AuthMiddleware(db, false), func(c *gin.Context) {
+		uid, err := uuid.Parse(c.GetString("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "error": gin.H{"code": "unauthorized", "message": "invalid user"}})
+			return
+		}
+		var u User
+		if err := db.Where("id = ?", uid).First(&u).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": gin.H{"code": "not_found", "message": "user not found"}})
+			return
+		}
+		if u.EmailVerifiedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "error": gin.H{"code": "already_verified", "message": "email already verified"}})
+			return
+		}
+		interval := envDuration("EMAIL_VERIFY_RESEND_INTERVAL", time.Minute)
+		var last ActionToken
+		if err := db.Where("user_id = ? AND purpose = ?", uid, purposeEmailVerify).Order("created_at desc").First(&last).Error; err == nil {
+			if wait := interval - time.Since(last.CreatedAt); wait > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "error": gin.H{"code": "too_many_requests", "message": "verification email was sent recently"}})
+				return
+			}
+		}
+		if err := sendVerificationEmail(db, u); err != nil {
+			log.Error().Err(err).Msg("verification_email_failed")
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": gin.H{"code": "db_error", "message": "cannot send verification email"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	})
+}